@@ -0,0 +1,233 @@
+package exchange
+
+import (
+	"errors"
+	. "github.com/gravel/models"
+	"time"
+)
+
+// Split every from shares of a stock into to shares, fewer shares for
+// a reverse split. Resting orders and positions are rescaled at once,
+// whatever falls short of a whole step of a position or an order is
+// dropped
+func (ex *Exchange) Split(code string, from, to int64) error {
+	if from <= 0 || to <= 0 || from == to {
+		return errors.New("Split must turn a positive number of shares into another")
+	}
+
+	action := &CorporateAction{
+		Kind:      ACTION_SPLIT,
+		StockCode: code,
+		From:      from,
+		To:        to,
+		Processed: true,
+	}
+
+	if err := ex.apply(action); err != nil {
+		return err
+	}
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	ex.actions[code] = append(ex.actions[code], action)
+	return nil
+}
+
+// Pay holders of a stock on the record date the amount per share in
+// the currency out of the payer account, nobody is paid if the payer
+// cannot pay everyone
+func (ex *Exchange) Dividend(code, payer, currency string, amount Decimal, record time.Time) error {
+	if currency == "" || !amount.IsPositive() {
+		return errors.New("Dividend must pay a positive amount in a currency")
+	}
+
+	if payer == "" {
+		return errors.New("Dividend must be paid by an account")
+	}
+
+	return ex.schedule(&CorporateAction{
+		Kind:      ACTION_CASH_DIVIDEND,
+		StockCode: code,
+		Ratio:     amount,
+		Currency:  currency,
+		Payer:     payer,
+		RecordTs:  record.Unix(),
+	})
+}
+
+// Pay holders of a stock on the record date new shares in proportion
+// to their holding, whatever falls short of a whole step is not paid
+func (ex *Exchange) StockDividend(code string, ratio Decimal, record time.Time) error {
+	if !ratio.IsPositive() {
+		return errors.New("Dividend must pay a positive amount")
+	}
+
+	return ex.schedule(&CorporateAction{
+		Kind:      ACTION_STOCK_DIVIDEND,
+		StockCode: code,
+		Ratio:     ratio,
+		RecordTs:  record.Unix(),
+	})
+}
+
+// The corporate actions of a stock, oldest first
+func (ex *Exchange) CorporateActions(code string) []*CorporateAction {
+	ex.RLock()
+	defer ex.RUnlock()
+	return append([]*CorporateAction{}, ex.actions[code]...)
+}
+
+// Keep a corporate action until its record date, the actions due are
+// processed right away
+func (ex *Exchange) schedule(action *CorporateAction) error {
+	ex.Lock()
+
+	stock, ok := ex.stocks[action.StockCode]
+
+	if !ok {
+		ex.Unlock()
+		return errors.New("Stock code not exist")
+	}
+
+	if err := fits(stock, action); err != nil {
+		ex.Unlock()
+		return err
+	}
+
+	ex.actions[action.StockCode] = append(ex.actions[action.StockCode], action)
+	ex.Unlock()
+
+	ex.process()
+	return nil
+}
+
+// Process every corporate action whose record date has come, an action
+// that cannot be applied records why
+func (ex *Exchange) process() {
+	var (
+		due []*CorporateAction
+	)
+
+	ex.Lock()
+
+	now := ex.now().Unix()
+
+	for _, actions := range ex.actions {
+		for _, action := range actions {
+			if !action.Processed && action.RecordTs <= now {
+				action.Processed = true
+				due = append(due, action)
+			}
+		}
+	}
+
+	ex.Unlock()
+
+	for _, action := range due {
+		if err := ex.apply(action); err != nil {
+			ex.Lock()
+			action.Error = err.Error()
+			ex.Unlock()
+		}
+	}
+}
+
+// Whether the stock can take the corporate action without leaving the
+// range of a decimal, no holder has more shares than the total supply
+func fits(s *Stock, action *CorporateAction) error {
+	var (
+		err error
+	)
+
+	switch action.Kind {
+	case ACTION_SPLIT:
+		_, err = s.TotalSupply.Scale(action.To, action.From)
+	case ACTION_CASH_DIVIDEND:
+		_, err = s.TotalSupply.CheckedMul(action.Ratio)
+	case ACTION_STOCK_DIVIDEND:
+		_, err = s.TotalSupply.CheckedMul(action.Ratio.Add(One))
+	}
+
+	if err != nil {
+		return errors.New("Corporate action is out of range for the stock")
+	}
+
+	return nil
+}
+
+// Apply a corporate action while the broker of the stock is paused.
+// The lock is held until the broker is done, so that every admitted
+// order is queued before the action and the book, the ledger and the
+// stock change together
+func (ex *Exchange) apply(action *CorporateAction) error {
+	code := action.StockCode
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, b := ex.stocks[code], ex.owners[code]
+
+	if stock == nil || b == nil {
+		return errors.New("Stock code not exist")
+	}
+
+	if err := fits(stock, action); err != nil {
+		return err
+	}
+
+	var (
+		allocations []*Allocation
+		step        = stock.AmountStep()
+		updated     = *stock
+		err         error
+	)
+
+	b.Apply(func() {
+		switch action.Kind {
+		case ACTION_SPLIT:
+			if updated.CirculatingSupply, err = b.split(action.From, action.To); err == nil {
+				updated.Split(action.From, action.To)
+			}
+		case ACTION_CASH_DIVIDEND:
+			payments := map[string]Decimal{}
+
+			for id, held := range ex.ledger.Holdings(code) {
+				payments[id] = held.Mul(action.Ratio)
+			}
+
+			err = ex.ledger.pay(action.Payer, action.Currency, payments)
+		case ACTION_STOCK_DIVIDEND:
+			for id, held := range ex.ledger.Holdings(code) {
+				if shares := held.Mul(action.Ratio).Truncate(step); shares.IsPositive() {
+					ex.ledger.issue(id, code, shares)
+					allocations = append(allocations, NewAllocation(id, shares))
+				}
+			}
+
+			paid, _ := allot(allocations)
+			updated.TotalSupply = updated.TotalSupply.Add(paid)
+			updated.CirculatingSupply = updated.CirculatingSupply.Add(paid)
+		}
+
+		// the broker publishes the stock as it is from now on
+		if err == nil {
+			b.Stock = &updated
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ex.stocks[code] = &updated
+
+	switch action.Kind {
+	case ACTION_SPLIT:
+		ex.account(SUPPLY_SPLIT, &updated, nil)
+	case ACTION_STOCK_DIVIDEND:
+		ex.account(SUPPLY_DIVIDEND, &updated, allocations)
+	}
+
+	return nil
+}
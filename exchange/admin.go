@@ -0,0 +1,132 @@
+package exchange
+
+import (
+	"errors"
+	. "github.com/gravel/models"
+)
+
+// Halt a stock, new orders and amendments are rejected while its
+// book is kept as it is and nothing matches, not even at the end of
+// an auction. Cancellations are still accepted
+func (ex *Exchange) Halt(code, reason string) error {
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, b := ex.stocks[code], ex.owners[code]
+
+	if stock == nil || b == nil {
+		return errors.New("Stock code not exist")
+	}
+
+	if ex.halted[code] {
+		return errors.New("Stock already halted")
+	}
+
+	b.Suspend()
+
+	ex.halted[code] = true
+	ex.record(AUDIT_ACTION_HALT, code, reason)
+	ex.publish(NewStockMessage(MESSAGE_COMMAND_HALT, stock))
+	return nil
+}
+
+// Resume trading a halted stock, the crossing orders queued meanwhile
+// trade unless the stock is in an auction
+func (ex *Exchange) Resume(code, reason string) error {
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, b := ex.stocks[code], ex.owners[code]
+
+	if stock == nil || b == nil {
+		return errors.New("Stock code not exist")
+	}
+
+	if !ex.halted[code] {
+		return errors.New("Stock not halted")
+	}
+
+	b.Reinstate()
+
+	delete(ex.halted, code)
+	ex.record(AUDIT_ACTION_RESUME, code, reason)
+	ex.publish(NewStockMessage(MESSAGE_COMMAND_RESUME, stock))
+	return nil
+}
+
+// Remove a stock from the exchange. Every order of the stock is
+// cancelled and its owner notified, the deals are archived and the
+// broker is free to serve another stock
+func (ex *Exchange) Delist(code, reason string) error {
+	// the lock is held until the broker is stopped, so that no order
+	// reaches the book and no halt is lifted while it is cleared
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, b := ex.stocks[code], ex.owners[code]
+
+	if stock == nil {
+		return errors.New("Stock code not exist")
+	}
+
+	if b != nil {
+		b.Clear()
+		b.Stop()
+	}
+
+	if quit, ok := ex.listeners[code]; ok {
+		close(quit)
+		delete(ex.listeners, code)
+	}
+
+	ex.archive[code] = ex.books[code].Histories()
+
+	delete(ex.stocks, code)
+	delete(ex.books, code)
+	delete(ex.owners, code)
+	delete(ex.schedules, code)
+	delete(ex.phases, code)
+	delete(ex.halted, code)
+
+	ex.record(AUDIT_ACTION_DELIST, code, reason)
+	ex.publish(NewStockMessage(MESSAGE_COMMAND_DELISTED, stock))
+	return nil
+}
+
+// The deals of a delisted stock keyed by market
+func (ex *Exchange) Archive(code string) (map[string][]*Deal, error) {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if histories, ok := ex.archive[code]; ok {
+		return histories, nil
+	}
+
+	return nil, errors.New("Stock not delisted")
+}
+
+// The administrative operations applied so far, oldest first
+func (ex *Exchange) Audit() []*AuditEntry {
+	ex.RLock()
+	defer ex.RUnlock()
+	return append([]*AuditEntry{}, ex.audit...)
+}
+
+// The caller must hold the lock
+func (ex *Exchange) record(action, code, reason string) {
+	ex.audit = append(ex.audit, &AuditEntry{
+		Action:    action,
+		StockCode: code,
+		Reason:    reason,
+		Timestamp: ex.now().Unix(),
+	})
+}
+
+// Publish an event for every client without ever blocking, events
+// are dropped while the consumer lags behind
+func (ex *Exchange) publish(msg *Message) {
+	select {
+	case ex.events <- msg:
+	default:
+	}
+}
@@ -1,17 +1,57 @@
 package exchange
 
 import (
+	"errors"
 	. "github.com/gravel/models"
 	"github.com/satori/go.uuid"
-	"math"
+	"time"
 )
 
-// A broker will match the orders listed in an exchange
+const (
+	// number of requests a broker buffers before callers block
+	REQUEST_BUFFER_SIZE = 1024
+)
+
+const (
+	REQUEST_TYPE_ADD = iota
+	REQUEST_TYPE_EXPIRE
+	REQUEST_TYPE_CANCEL
+	REQUEST_TYPE_AMEND
+	REQUEST_TYPE_AUCTION
+	REQUEST_TYPE_UNCROSS
+	REQUEST_TYPE_RESUME
+	REQUEST_TYPE_CLEAR
+	REQUEST_TYPE_APPLY
+	REQUEST_TYPE_SUSPEND
+	REQUEST_TYPE_REINSTATE
+)
+
+// A request is applied by the broker owning the orderbook,
+// requests are handled one at a time in the order received
+type request struct {
+	kind   int
+	order  *Order
+	id     string
+	owner  string
+	action func()
+	reply  chan *response
+}
+
+// The outcome of a request the caller waits for
+type response struct {
+	order *Order
+	err   error
+}
+
+// A broker will match the orders listed in an exchange,
+// it is the single writer of the orderbook it watches
 type Broker struct {
 	BrokerId string
-	Ask      OrderQueue
-	Bid      OrderQueue
+	Stock    *Stock
+	Book     *OrderBook
 	Deals    chan *Deal
+	exchange *Exchange
+	requests chan *request
 	idle     bool
 	exit     chan bool
 }
@@ -19,69 +59,1004 @@ type Broker struct {
 func NewBroker() *Broker {
 	return &Broker{
 		BrokerId: uuid.NewV4().String(),
+		requests: make(chan *request, REQUEST_BUFFER_SIZE),
 		idle:     true,
+		exit:     make(chan bool),
 	}
 }
 
-func (b *Broker) Watch(ask OrderQueue, bid OrderQueue, deals chan *Deal) {
-	b.Ask = ask
-	b.Bid = bid
-	b.Deals = deals
+// Watch a book, requests left over from a book watched before are
+// never applied to it
+func (b *Broker) Watch(s *Stock, book *OrderBook) {
+	b.Stock = s
+	b.Book = book
+	b.Deals = book.Deals
+	b.requests = make(chan *request, REQUEST_BUFFER_SIZE)
 }
 
 func (b *Broker) Start() {
 
-	// no watched queue exist or broker already start
-	if b.Ask == nil || b.Bid == nil || !b.IsIdle() {
+	// no watched book exist or broker already start
+	if b.Book == nil || !b.IsIdle() {
 		return
 	}
 
 	b.idle = false
 
+	requests := b.requests
+
 	// start looping
 	go func() {
-		// todo: modify busy waiting to chan
 		for {
-
 			select {
 			case <-b.exit:
-				b.idle = true
 				return
-			default:
-
-				if oask, obid := b.Ask.Peek(0), b.Bid.Peek(0); oask != nil && obid != nil {
-					if oask.Price <= obid.Price {
-						if oask.Amount == obid.Amount {
-							b.Deals <- Match(b.Ask.Next(), b.Bid.Next())
-						} else if oask.Amount < obid.Amount {
-							b.Deals <- Match(b.Ask.Next(), obid)
-						} else {
-							b.Deals <- Match(oask, b.Bid.Next())
-						}
-					}
-				}
+			case req := <-requests:
+				b.handle(req)
 			}
 		}
 	}()
 }
 
+// Submit an order to the book, it is queued and matched
+// by the broker goroutine
+func (b *Broker) Submit(o *Order) {
+	b.requests <- &request{
+		kind:  REQUEST_TYPE_ADD,
+		order: o,
+	}
+}
+
+// Cancel a resting order, an owner other than empty must match the
+// order's. The cancelled order carries its remaining amount
+func (b *Broker) Cancel(id, owner string) (*Order, error) {
+	reply := make(chan *response, 1)
+
+	b.requests <- &request{
+		kind:  REQUEST_TYPE_CANCEL,
+		id:    id,
+		owner: owner,
+		reply: reply,
+	}
+
+	res := <-reply
+	return res.order, res.err
+}
+
+// Amend the price and amount of a resting order, an owner other than
+// empty must match the order's. The amended order is returned as a copy
+func (b *Broker) Amend(id, owner string, price, amount Decimal) (*Order, error) {
+	reply := make(chan *response, 1)
+
+	b.requests <- &request{
+		kind: REQUEST_TYPE_AMEND,
+		order: &Order{
+			Price:  price,
+			Amount: amount,
+		},
+		id:    id,
+		owner: owner,
+		reply: reply,
+	}
+
+	res := <-reply
+	return res.order, res.err
+}
+
+// Start a call auction, orders accumulate without matching until
+// the book is uncrossed
+func (b *Broker) Auction() error {
+	return b.call(REQUEST_TYPE_AUCTION)
+}
+
+// End the call auction, every market trades at its uncrossing price
+// and the book returns to continuous matching
+func (b *Broker) Uncross() error {
+	return b.call(REQUEST_TYPE_UNCROSS)
+}
+
+// Stop matching the book on behalf of an operator, the orders queue
+// until it is reinstated
+func (b *Broker) Suspend() error {
+	return b.call(REQUEST_TYPE_SUSPEND)
+}
+
+// Lift a suspension, the orders queued meanwhile are uncrossed unless
+// the book is still paused otherwise
+func (b *Broker) Reinstate() error {
+	return b.call(REQUEST_TYPE_REINSTATE)
+}
+
+// Cancel every order of the book, waiting or resting
+func (b *Broker) Clear() error {
+	return b.call(REQUEST_TYPE_CLEAR)
+}
+
+// Run an adjustment of the book between two requests, no order
+// matches until it returns
+func (b *Broker) Apply(action func()) {
+	reply := make(chan *response, 1)
+
+	b.requests <- &request{
+		kind:   REQUEST_TYPE_APPLY,
+		action: action,
+		reply:  reply,
+	}
+
+	<-reply
+}
+
+// Send a request about the whole book and wait for its outcome
+func (b *Broker) call(kind int) error {
+	reply := make(chan *response, 1)
+
+	b.requests <- &request{
+		kind:  kind,
+		reply: reply,
+	}
+
+	return (<-reply).err
+}
+
+func (b *Broker) handle(req *request) {
+	switch req.kind {
+	case REQUEST_TYPE_ADD:
+		b.add(req.order)
+		b.trigger(req.order.Market)
+	case REQUEST_TYPE_EXPIRE:
+		var (
+			own, _   = b.queues(req.order)
+			triggers = b.Book.Triggers(req.order.Market)
+		)
+
+		// an order expiring during a call auction may still trade at
+		// the uncrossing, e.g. a day order in the closing auction
+		if b.Book.InAuction() && own.Find(req.order.OrderId) != nil {
+			b.retry(req.order)
+		} else if own.Remove(req.order.OrderId) != nil || triggers.Remove(req.order.OrderId) != nil {
+			b.exchange.ledger.Release(req.order)
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_EXPIRED, req.order))
+		}
+	case REQUEST_TYPE_CANCEL:
+		order, err := b.cancel(req.id, req.owner)
+		if err == nil {
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_CANCELLED, order))
+		}
+		req.reply <- &response{order, err}
+	case REQUEST_TYPE_AMEND:
+		order, err := b.amend(req.id, req.owner, req.order)
+		if err == nil {
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_AMENDED, order))
+			b.trigger(order.Market)
+		}
+		req.reply <- &response{order, err}
+	case REQUEST_TYPE_AUCTION:
+		var err error
+		if b.Book.InAuction() {
+			err = errors.New("Auction already open")
+		} else {
+			b.Book.SetAuction(true)
+		}
+		req.reply <- &response{err: err}
+	case REQUEST_TYPE_UNCROSS:
+		var err error
+		if !b.Book.InAuction() {
+			err = errors.New("No auction open")
+		} else {
+			b.Book.SetAuction(false)
+
+			if !b.paused() {
+				b.uncross()
+			}
+		}
+		req.reply <- &response{err: err}
+	case REQUEST_TYPE_RESUME:
+		if b.Book.IsHalted() {
+			b.resume()
+		}
+	case REQUEST_TYPE_SUSPEND:
+		b.Book.SetSuspended(true)
+		req.reply <- &response{}
+	case REQUEST_TYPE_REINSTATE:
+		b.Book.SetSuspended(false)
+
+		if !b.paused() {
+			b.uncross()
+		}
+		req.reply <- &response{}
+	case REQUEST_TYPE_CLEAR:
+		b.clear()
+		req.reply <- &response{}
+	case REQUEST_TYPE_APPLY:
+		req.action()
+		req.reply <- &response{}
+	}
+}
+
+// Look up a resting order of the owner in any market of the book
+func (b *Broker) find(id, owner string) (OrderQueue, *Order) {
+	for _, market := range b.Book.Markets() {
+		for _, side := range []string{ORDER_TYPE_ASK, ORDER_TYPE_BID} {
+			queue := b.Book.GetQueue(QueueKey(market, side))
+
+			if o := queue.Find(id); o != nil {
+				if owner != "" && o.Owner != owner {
+					return nil, nil
+				}
+				return queue, o
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Look up a stop order of the owner waiting in any market of the book
+func (b *Broker) findStop(id, owner string) (*TriggerBook, *Order) {
+	for _, market := range b.Book.Markets() {
+		triggers := b.Book.Triggers(market)
+
+		if o := triggers.Find(id); o != nil {
+			if owner != "" && o.Owner != owner {
+				return nil, nil
+			}
+			return triggers, o
+		}
+	}
+	return nil, nil
+}
+
+func (b *Broker) cancel(id, owner string) (*Order, error) {
+	if triggers, o := b.findStop(id, owner); o != nil {
+		triggers.Remove(o.OrderId)
+		b.exchange.ledger.Release(o)
+		return o, nil
+	}
+
+	queue, o := b.find(id, owner)
+
+	if o == nil {
+		return nil, errors.New("Order does not exist")
+	}
+
+	queue.Remove(o.OrderId)
+	b.exchange.ledger.Release(o)
+	return o, nil
+}
+
+// A new price may cross the book, the order then trades as if it
+// had just arrived. Otherwise the queue applies the priority rules
+func (b *Broker) amend(id, owner string, n *Order) (*Order, error) {
+	if _, o := b.findStop(id, owner); o != nil {
+		return b.amendStop(o, n)
+	}
+
+	queue, o := b.find(id, owner)
+
+	if o == nil {
+		return nil, errors.New("Order does not exist")
+	}
+
+	if err := b.exchange.ledger.Rehold(o, n.Price, n.Amount); err != nil {
+		return nil, err
+	}
+
+	// the amount of an iceberg order includes what it hides
+	if n.Price != o.Price || o.IsIceberg() {
+		queue.Remove(o.OrderId)
+		o.Price = n.Price
+		o.Amount = n.Amount
+		o.HiddenAmount = Zero
+		o.Total = o.Price.Mul(o.Amount)
+		o.Restamp()
+		b.execute(o)
+	} else if err := queue.Update(o.OrderId, n); err != nil {
+		return nil, err
+	}
+
+	amended := *o
+	return &amended, nil
+}
+
+// Cancel every order of the book and notify their owners
+func (b *Broker) clear() {
+	for _, market := range b.Book.Markets() {
+		cancelled := b.Book.Triggers(market).Drain()
+
+		for _, side := range []string{ORDER_TYPE_ASK, ORDER_TYPE_BID} {
+			queue := b.Book.GetQueue(QueueKey(market, side))
+
+			for o := queue.Next(); o != nil; o = queue.Next() {
+				cancelled = append(cancelled, o)
+			}
+		}
+
+		for _, o := range cancelled {
+			b.exchange.ledger.Release(o)
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_CANCELLED, o))
+		}
+	}
+}
+
+// Rescale every order of the book, the positions of the stock and the
+// price bands for a split giving to new shares for every from shares.
+// Orders keep their priority, those left with nothing are cancelled and
+// their owners notified. The book is left as it is if anything would
+// leave the range of a decimal. It returns the shares the holders are
+// left with
+func (b *Broker) split(from, to int64) (Decimal, error) {
+	var (
+		tick    = b.Stock.PriceStep()
+		lot     = b.Stock.AmountStep()
+		held    = map[string]Decimal{}
+		dropped = []*Order{}
+	)
+
+	if !b.splits(from, to, tick) {
+		return Zero, errors.New("Split is out of range for the orders of the stock")
+	}
+
+	for _, market := range b.Book.Markets() {
+		triggers := b.Book.Triggers(market)
+		dropped = append(dropped, triggers.Split(from, to, tick, lot)...)
+
+		for _, side := range []string{ORDER_TYPE_ASK, ORDER_TYPE_BID} {
+			var (
+				queue  = b.Book.GetQueue(QueueKey(market, side))
+				orders = []*Order{}
+			)
+
+			for o := queue.Next(); o != nil; o = queue.Next() {
+				orders = append(orders, o)
+			}
+
+			for _, o := range orders {
+				if o.Split(from, to, tick, lot) {
+					queue.Add(o)
+				} else {
+					dropped = append(dropped, o)
+				}
+			}
+		}
+
+		// the shares the asks of the market hold once rescaled
+		hold := func(o *Order) bool {
+			if o.Type == ORDER_TYPE_ASK {
+				held[o.Owner] = held[o.Owner].Add(o.Reserved)
+			}
+			return true
+		}
+
+		triggers.Range(hold)
+		b.Book.GetQueue(QueueKey(market, ORDER_TYPE_ASK)).Range(hold)
+	}
+
+	for _, o := range dropped {
+		b.exchange.ledger.Release(o)
+		b.notify(NewOrderMessage(MESSAGE_COMMAND_CANCELLED, o))
+	}
+
+	if bands := b.Book.Bands(); bands != nil {
+		rescaled := *bands
+		rescaled.Reference, _ = rescaled.Reference.Scale(from, to)
+		b.Book.SetBands(&rescaled)
+	}
+
+	return b.exchange.ledger.Split(b.Stock.Code, from, to, lot, held), nil
+}
+
+// Whether every order and price of the book can be rescaled for a split
+func (b *Broker) splits(from, to int64, tick Decimal) bool {
+	var (
+		ok     = true
+		splits = func(o *Order) bool {
+			ok = ok && o.Splits(from, to, tick)
+			return ok
+		}
+	)
+
+	if bands := b.Book.Bands(); bands != nil {
+		if _, err := bands.Reference.Scale(from, to); err != nil {
+			return false
+		}
+	}
+
+	for _, market := range b.Book.Markets() {
+		triggers := b.Book.Triggers(market)
+
+		if _, err := triggers.Last().Scale(from, to); err != nil {
+			return false
+		}
+
+		triggers.Range(splits)
+		b.Book.GetQueue(QueueKey(market, ORDER_TYPE_ASK)).Range(splits)
+		b.Book.GetQueue(QueueKey(market, ORDER_TYPE_BID)).Range(splits)
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A waiting stop order only changes its limit, it cannot trade
+// before it is triggered
+func (b *Broker) amendStop(o, n *Order) (*Order, error) {
+	if o.IsMarket() {
+		return nil, errors.New("Stop market orders cannot be amended")
+	}
+
+	if err := b.exchange.ledger.Rehold(o, n.Price, n.Amount); err != nil {
+		return nil, err
+	}
+
+	o.Price = n.Price
+	o.Amount = n.Amount
+	o.Total = o.Price.Mul(o.Amount)
+
+	amended := *o
+	return &amended, nil
+}
+
+// A stop order waits in the trigger book of its market, any other
+// order trades on arrival. A market bid is rejected when nothing is
+// left to fund it
+func (b *Broker) add(o *Order) {
+	if !o.IsStop() {
+		if deferred(o) && b.exchange.ledger.Reserve(o) != nil {
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_REJECTED, o))
+			return
+		}
+
+		b.execute(o)
+		return
+	}
+
+	b.Book.Triggers(o.Market).Add(o)
+
+	if o.Expires() {
+		b.expire(o)
+	}
+}
+
+// Release the stop orders of the market reached by the last trade
+// price, they trade as if they had just arrived and their trades may
+// trigger further stops. A stop market bid is rejected when nothing is
+// left to fund it
+func (b *Broker) trigger(market string) {
+	triggers := b.Book.Triggers(market)
+
+	for released := triggers.Release(); len(released) > 0; released = triggers.Release() {
+		for _, o := range released {
+			if deferred(o) && b.exchange.ledger.Reserve(o) != nil {
+				b.notify(NewOrderMessage(MESSAGE_COMMAND_REJECTED, o))
+				continue
+			}
+
+			o.Restamp()
+			b.report(MESSAGE_COMMAND_TRIGGERED, o)
+			b.execute(o)
+		}
+	}
+}
+
+// Trade an incoming order against the opposite side of the book,
+// whatever remains of a limit order then rests in its own queue.
+// Every fill is charged its fees and settled in the ledger, an order
+// leaving the book releases what it still holds. During a call auction
+// the order only rests
+func (b *Broker) execute(o *Order) {
+	var (
+		own, opposite = b.queues(o)
+		limit         = b.limit(o, opposite)
+		pricing       = b.Book.Pricing()
+		bands         = b.Book.Bands()
+		breaker       = b.Book.Breaker()
+		ledger        = b.exchange.ledger
+	)
+
+	if b.paused() {
+		b.accumulate(o, own)
+		return
+	}
+
+	if o.PostOnly != "" && !b.post(o, opposite) {
+		ledger.Release(o)
+		b.notify(NewOrderMessage(MESSAGE_COMMAND_REJECTED, o))
+		return
+	}
+
+	if o.TimeInForce == TIME_IN_FORCE_FOK && !b.fillable(o, opposite, limit) {
+		ledger.Release(o)
+		b.notify(NewOrderMessage(MESSAGE_COMMAND_EXPIRED, o))
+		return
+	}
+
+	for o.Amount.IsPositive() {
+		if b.paused() {
+			b.accumulate(o, own)
+			return
+		}
+
+		top := opposite.Peek(0)
+
+		if top == nil || !o.Accepts(top.Price) || !limit(top.Price) {
+			break
+		}
+
+		if b.prevents(o, top) {
+			if b.prevent(o, top, opposite) {
+				continue
+			}
+			ledger.Release(o)
+			b.notify(NewOrderMessage(MESSAGE_COMMAND_PREVENTED, o))
+			return
+		}
+
+		var (
+			price  = pricing(top, o, b.Stock.PriceStep())
+			amount = b.quantity(top, o, price)
+			last   = b.Book.Triggers(o.Market).Last()
+		)
+
+		// a trade outside the price bands never happens, the order
+		// stops trading instead
+		if !amount.IsPositive() || bands != nil && !bands.Allows(price, last) {
+			break
+		}
+
+		deal := b.trade(top, o, price, amount)
+		b.deplete(top, opposite)
+		b.Deals <- deal
+
+		if breaker != nil && breaker.Trips(price, last) {
+			b.halt(breaker.Period)
+		}
+	}
+
+	if o.Amount.IsZero() {
+		ledger.Release(o)
+		return
+	}
+
+	if !o.IsResting() {
+		ledger.Release(o)
+		b.notify(NewOrderMessage(MESSAGE_COMMAND_EXPIRED, o))
+		return
+	}
+
+	b.rest(o, own)
+}
+
+// Keep a post-only order from taking liquidity, an order crossing the
+// book is repriced one tick behind the best opposite price if it asks
+// so. It reports whether the order may rest
+func (b *Broker) post(o *Order, opposite OrderQueue) bool {
+	top := opposite.Peek(0)
+
+	if top == nil || !o.Accepts(top.Price) {
+		return true
+	}
+
+	if o.PostOnly != POST_ONLY_REPRICE {
+		return false
+	}
+
+	price := top.Price.Add(b.Stock.PriceStep())
+
+	if o.Type == ORDER_TYPE_BID {
+		price = top.Price.Sub(b.Stock.PriceStep())
+	}
+
+	if !price.IsPositive() || b.exchange.ledger.Rehold(o, price, o.Remaining()) != nil {
+		return false
+	}
+
+	o.Price = price
+	o.Total = o.Price.Mul(o.Amount)
+	return true
+}
+
+// Match a maker and a taker, charge their fees and settle the deal.
+// The deal is published by the caller once the book reflects it
+func (b *Broker) trade(maker, taker *Order, price, amount Decimal) *Deal {
+	var (
+		deal   = Match(maker, taker, price, amount)
+		fees   = b.Book.Fees()
+		ledger = b.exchange.ledger
+		bid    = maker
+	)
+
+	if taker.Type == ORDER_TYPE_BID {
+		bid = taker
+	}
+
+	// every fill rounds its total on its own, together they may come
+	// to a unit more than the bid holds
+	if deal.Total.GreaterThan(bid.Reserved) {
+		deal.Total = bid.Reserved
+	}
+
+	deal.Charge(
+		fees.Rate(ledger.Tier(maker.Owner)).Maker,
+		fees.Rate(ledger.Tier(taker.Owner)).Taker,
+	)
+
+	if taker.Type == ORDER_TYPE_ASK {
+		ledger.Settle(taker, maker, deal)
+	} else {
+		ledger.Settle(maker, taker, deal)
+	}
+
+	b.Book.Triggers(taker.Market).Follow(price)
+	return deal
+}
+
+// Take a filled order off its queue, an iceberg order displays its
+// next slice instead
+func (b *Broker) deplete(o *Order, queue OrderQueue) {
+	if !o.Amount.IsZero() {
+		return
+	}
+
+	queue.Remove(o.OrderId)
+
+	if o.Replenish() {
+		queue.Add(o)
+	} else {
+		b.exchange.ledger.Release(o)
+	}
+}
+
+// Rest an order during a call auction, an order that may not rest is
+// rejected as it cannot wait for the uncrossing
+func (b *Broker) accumulate(o *Order, own OrderQueue) {
+	if !o.IsResting() {
+		b.exchange.ledger.Release(o)
+		b.notify(NewOrderMessage(MESSAGE_COMMAND_REJECTED, o))
+		return
+	}
+
+	b.rest(o, own)
+}
+
+// Rest what remains of an order in its queue
+func (b *Broker) rest(o *Order, own OrderQueue) {
+	o.Conceal()
+	own.Add(o)
+
+	// a stop order has been scheduled to expire when it was placed
+	if o.Expires() && !o.IsStop() {
+		b.expire(o)
+	}
+}
+
+// Trade every market at its uncrossing price, the oldest of each
+// pair of crossing orders is the maker. The newest of a pair placed by
+// the same owner asks how to prevent their self trade, as it would
+// on arrival. The last trade prices may then trigger stop orders. The
+// caller lifts the auction or halt first
+func (b *Broker) uncross() {
+	for _, market := range b.Book.Markets() {
+		var (
+			ask     = b.Book.GetQueue(QueueKey(market, ORDER_TYPE_ASK))
+			bid     = b.Book.GetQueue(QueueKey(market, ORDER_TYPE_BID))
+			auction = Equilibrium(ask, bid, b.Book.Triggers(market).Last())
+		)
+
+		for left := auction.Volume; left.IsPositive() && !ask.IsEmpty() && !bid.IsEmpty(); {
+			var (
+				seller = ask.Peek(0)
+				buyer  = bid.Peek(0)
+				amount = MinDecimal(seller.Amount, buyer.Amount)
+				maker  = seller
+				taker  = buyer
+			)
+
+			if !seller.Accepts(auction.Price) || !buyer.Accepts(auction.Price) {
+				break
+			}
+
+			if buyer.Before(seller) {
+				maker, taker = buyer, seller
+			}
+
+			if b.prevents(taker, maker) {
+				own, opposite := b.queues(taker)
+
+				if !b.prevent(taker, maker, opposite) {
+					b.withdraw(taker, own)
+				}
+				continue
+			}
+
+			deal := b.trade(maker, taker, auction.Price, amount)
+			b.deplete(seller, ask)
+			b.deplete(buyer, bid)
+			b.Deals <- deal
+			left = left.Sub(amount)
+		}
+	}
+
+	for _, market := range b.Book.Markets() {
+		b.trigger(market)
+	}
+}
+
+// Pause the matching of the book for the period of its circuit
+// breaker, the orders queue as in an auction until it resumes
+func (b *Broker) halt(period time.Duration) {
+	b.Book.SetHalted(true)
+	b.exchange.publish(NewStockMessage(MESSAGE_COMMAND_HALT, b.Stock))
+
+	// the book may no longer be watched once the period is over
+	requests := b.requests
+
+	time.AfterFunc(period, func() {
+		requests <- &request{
+			kind: REQUEST_TYPE_RESUME,
+		}
+	})
+}
+
+// Lift a halt, the orders queued meanwhile are uncrossed unless the
+// book is in a call auction or suspended anyway, in which case trading
+// does not resume either
+func (b *Broker) resume() {
+	b.Book.SetHalted(false)
+
+	if !b.paused() {
+		b.exchange.publish(NewStockMessage(MESSAGE_COMMAND_RESUME, b.Stock))
+		b.uncross()
+	}
+}
+
+// Whether orders queue instead of matching
+func (b *Broker) paused() bool {
+	return b.Book.InAuction() || b.Book.IsHalted() || b.Book.IsSuspended()
+}
+
+// The amount a maker and a taker trade at the price, a market bid
+// is bounded by the cash it holds
+func (b *Broker) quantity(maker, taker *Order, price Decimal) Decimal {
+	amount := MinDecimal(maker.Amount, taker.Amount)
+
+	if taker.IsMarket() && taker.Type == ORDER_TYPE_BID {
+		amount = b.affordable(taker.Reserved, price, amount)
+	}
+
+	return amount
+}
+
+// The largest amount up to the given one in whole steps of the stock
+// that the cash pays for
+func (b *Broker) affordable(cash, price, amount Decimal) Decimal {
+	if total, err := price.CheckedMul(amount); err == nil && !total.GreaterThan(cash) {
+		return amount
+	}
+
+	// the cash pays for less than the amount, the quotient is in range
+	var (
+		step       = b.Stock.AmountStep()
+		affordable = cash.Div(price).Truncate(step)
+	)
+
+	if price.Mul(affordable).GreaterThan(cash) {
+		affordable = affordable.Sub(step)
+	}
+
+	return affordable
+}
+
+// Whether the opposite side holds enough quantity at acceptable
+// prices to fill the order completely. The sweep stops where a trade
+// would leave the price bands or trip the circuit breaker, as the
+// order would stop trading there
+func (b *Broker) fillable(o *Order, opposite OrderQueue, limit func(price Decimal) bool) bool {
+	var (
+		available Decimal
+		cash      = o.Reserved
+		pricing   = b.Book.Pricing()
+		bands     = b.Book.Bands()
+		breaker   = b.Book.Breaker()
+		last      = b.Book.Triggers(o.Market).Last()
+	)
+
+	opposite.Range(func(top *Order) bool {
+		if !o.Accepts(top.Price) || !limit(top.Price) {
+			return false
+		}
+
+		// only the resting orders of the owner are cancelled, in the
+		// other modes the order stops filling when it meets one
+		if b.prevents(o, top) {
+			return o.SelfTrade == SELF_TRADE_CANCEL_OLDEST
+		}
+
+		var (
+			price  = pricing(top, o, b.Stock.PriceStep())
+			amount = top.Remaining()
+		)
+
+		if bands != nil && !bands.Allows(price, last) {
+			return false
+		}
+
+		if o.IsMarket() && o.Type == ORDER_TYPE_BID {
+			amount = b.affordable(cash, price, amount)
+			cash = cash.Sub(price.Mul(amount))
+		}
+
+		available = available.Add(amount)
+
+		// a tripped breaker halts the book right after the trade
+		if breaker != nil && breaker.Trips(price, last) {
+			return false
+		}
+
+		last = price
+		return available.LessThan(o.Amount) && amount.IsPositive()
+	})
+
+	return !available.LessThan(o.Amount)
+}
+
+// Whether the incoming order must not trade with the resting one
+func (b *Broker) prevents(o, top *Order) bool {
+	return o.SelfTrade != "" && o.Owner != "" && o.Owner == top.Owner
+}
+
+// Resolve an incoming order meeting a resting order of its owner as
+// the incoming order asks, before they are ever matched. It reports
+// whether the incoming order keeps trading
+func (b *Broker) prevent(o, top *Order, opposite OrderQueue) bool {
+	switch o.SelfTrade {
+	case SELF_TRADE_CANCEL_OLDEST:
+		b.withdraw(top, opposite)
+		return true
+	case SELF_TRADE_CANCEL_BOTH:
+		b.withdraw(top, opposite)
+		return false
+	case SELF_TRADE_DECREMENT:
+		amount := MinDecimal(top.Amount, o.Amount)
+		b.decrement(top, amount)
+		b.decrement(o, amount)
+
+		if top.Amount.IsZero() && opposite.Remove(top.OrderId) != nil && top.Replenish() {
+			opposite.Add(top)
+		}
+
+		if top.Amount.IsZero() {
+			b.withdraw(top, opposite)
+		} else {
+			b.report(MESSAGE_COMMAND_DECREMENTED, top)
+		}
+
+		if o.Amount.IsZero() {
+			return false
+		}
+
+		b.report(MESSAGE_COMMAND_DECREMENTED, o)
+		return true
+	}
+	return false
+}
+
+// Cancel a resting order to prevent a self trade
+func (b *Broker) withdraw(o *Order, queue OrderQueue) {
+	queue.Remove(o.OrderId)
+	b.exchange.ledger.Release(o)
+	b.notify(NewOrderMessage(MESSAGE_COMMAND_PREVENTED, o))
+}
+
+// Reduce an order and release the funds it no longer needs, a market
+// bid holds its cash until it stops trading
+func (b *Broker) decrement(o *Order, amount Decimal) {
+	o.Amount = o.Amount.Sub(amount)
+	o.Total = o.Price.Mul(o.Amount)
+
+	if !o.IsMarket() || o.Type == ORDER_TYPE_ASK {
+		b.exchange.ledger.Rehold(o, o.Price, o.Remaining())
+	}
+}
+
+// Schedule the removal of a resting order when it expires by the clock
+// of the exchange
+func (b *Broker) expire(o *Order) {
+	b.after(time.Unix(o.ExpireTs, 0).Sub(b.exchange.now()), o)
+}
+
+// Try the removal of an expired order again once the phase may have
+// changed
+func (b *Broker) retry(o *Order) {
+	b.after(SESSION_INTERVAL, o)
+}
+
+func (b *Broker) after(d time.Duration, o *Order) {
+	requests := b.requests
+
+	time.AfterFunc(d, func() {
+		requests <- &request{
+			kind:  REQUEST_TYPE_EXPIRE,
+			order: o,
+		}
+	})
+}
+
+// Publish a notice without ever blocking the matching,
+// notices are dropped while the consumer lags behind
+func (b *Broker) notify(msg *Message) {
+	select {
+	case b.exchange.notices <- msg:
+	default:
+	}
+}
+
+// Notify the owner of an order the broker keeps trading, the notice
+// carries a copy of the order as it stands
+func (b *Broker) report(command string, o *Order) {
+	reported := *o
+	b.notify(NewOrderMessage(command, &reported))
+}
+
+// The queue an order rests in and the one it trades against,
+// both in the market of the order
+func (b *Broker) queues(o *Order) (OrderQueue, OrderQueue) {
+	var (
+		ask = b.Book.GetQueue(QueueKey(o.Market, ORDER_TYPE_ASK))
+		bid = b.Book.GetQueue(QueueKey(o.Market, ORDER_TYPE_BID))
+	)
+
+	if o.Type == ORDER_TYPE_ASK {
+		return ask, bid
+	}
+	return bid, ask
+}
+
+// The slippage protection of a market order, bounded by the best
+// opposite price when the order arrives
+func (b *Broker) limit(o *Order, opposite OrderQueue) func(price Decimal) bool {
+	best := opposite.Peek(0)
+
+	if !o.IsMarket() || !o.Slippage.IsPositive() || best == nil {
+		return func(price Decimal) bool {
+			return true
+		}
+	}
+
+	if o.Type == ORDER_TYPE_ASK {
+		floor := best.Price.Mul(One.Sub(o.Slippage))
+		return func(price Decimal) bool {
+			return !price.LessThan(floor)
+		}
+	}
+
+	ceiling := best.Price.Mul(One.Add(o.Slippage))
+	return func(price Decimal) bool {
+		return !price.GreaterThan(ceiling)
+	}
+}
+
 func (b *Broker) Stop() {
-	b.Ask = nil
-	b.Bid = nil
+	if b.IsIdle() {
+		return
+	}
+
 	b.exit <- true
+	b.Book = nil
+	b.requests = make(chan *request, REQUEST_BUFFER_SIZE)
+	b.idle = true
 }
 
 func (b *Broker) IsIdle() bool {
 	return b.idle
 }
 
-func Match(ask *Order, bid *Order) *Deal {
-	var (
-		amount = math.Min(ask.Amount, bid.Amount)
-	)
-
-	ask.Amount -= amount
-	bid.Amount -= amount
+// Trade a resting (maker) order against an incoming (taker) one,
+// the caller decides the price and amount of the trade
+func Match(maker *Order, taker *Order, price, amount Decimal) *Deal {
+	maker.Amount = maker.Amount.Sub(amount)
+	taker.Amount = taker.Amount.Sub(amount)
 
-	return NewDeal(ask.Price, amount)
+	return NewDeal(maker, taker, price, amount)
 }
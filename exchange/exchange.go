@@ -3,6 +3,16 @@ package exchange
 import (
 	"errors"
 	. "github.com/gravel/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// number of notices kept for a lagging consumer before dropping
+	NOTICE_BUFFER_SIZE = 1024
+	// how often the trading phases are checked against the clock
+	SESSION_INTERVAL = time.Second
 )
 
 type Exchange struct {
@@ -12,37 +22,112 @@ type Exchange struct {
 	stocks map[string]*Stock
 	// orderbooks
 	books map[string]*OrderBook
-	exit  chan bool
+	// the broker owning each orderbook
+	owners map[string]*Broker
+	// notices for order owners
+	notices chan *Message
+	// events for every client
+	events chan *Message
+	// balances of every account
+	ledger *Ledger
+	// trading calendars and the current phase of each stock
+	schedules map[string]*Schedule
+	phases    map[string]string
+	clock     atomic.Value
+	// stocks halted by an operator
+	halted map[string]bool
+	// the deals of delisted stocks keyed by stock and market
+	archive map[string]map[string][]*Deal
+	// administrative operations in the order applied
+	audit []*AuditEntry
+	// changes in the shares of each stock
+	supply map[string][]*SupplyEvent
+	// corporate actions of each stock
+	actions map[string][]*CorporateAction
+	// stops recording the deals of each book
+	listeners map[string]chan struct{}
+	exit      chan bool
+	done      chan struct{}
+	sync.RWMutex
 }
 
 func NewExchange() *Exchange {
-	return &Exchange{
-		pool:   map[string]*Broker{},
-		stocks: map[string]*Stock{},
-		books:  map[string]*OrderBook{},
-		exit:   make(chan bool),
+	ex := &Exchange{
+		pool:      map[string]*Broker{},
+		stocks:    map[string]*Stock{},
+		books:     map[string]*OrderBook{},
+		owners:    map[string]*Broker{},
+		notices:   make(chan *Message, NOTICE_BUFFER_SIZE),
+		events:    make(chan *Message, NOTICE_BUFFER_SIZE),
+		ledger:    NewLedger(),
+		schedules: map[string]*Schedule{},
+		phases:    map[string]string{},
+		halted:    map[string]bool{},
+		archive:   map[string]map[string][]*Deal{},
+		audit:     []*AuditEntry{},
+		supply:    map[string][]*SupplyEvent{},
+		actions:   map[string][]*CorporateAction{},
+		listeners: map[string]chan struct{}{},
+		exit:      make(chan bool),
+		done:      make(chan struct{}),
 	}
+
+	ex.clock.Store(Clock(time.Now))
+	return ex
 }
 
 func (ex *Exchange) Register(b *Broker) {
+	ex.Lock()
+	defer ex.Unlock()
+	b.exchange = ex
 	ex.pool[b.BrokerId] = b
 }
 
 func (ex *Exchange) DeRegister(id string) {
+	ex.Lock()
+	defer ex.Unlock()
+
 	if b, ok := ex.pool[id]; ok {
+		for code, owner := range ex.owners {
+			if owner == b {
+				delete(ex.owners, code)
+			}
+		}
 		b.Stop()
 		delete(ex.pool, id)
 	}
 }
 
+func (ex *Exchange) Ledger() *Ledger {
+	return ex.ledger
+}
+
+// The stream of notices addressed to order owners, e.g. expiries
+func (ex *Exchange) Notices() <-chan *Message {
+	return ex.notices
+}
+
+// The stream of events for every client, e.g. phase transitions
+func (ex *Exchange) Events() <-chan *Message {
+	return ex.events
+}
+
 func (ex *Exchange) Broadcast() *Message {
 
 	var (
 		payload []*Summary
 	)
 
-	for _, book := range ex.books {
-		payload = append(payload, book.Sum())
+	ex.RLock()
+	defer ex.RUnlock()
+
+	for code, book := range ex.books {
+		for _, market := range book.Markets() {
+			summary := book.Sum(market)
+			summary.Phase = ex.phase(code)
+			summary.Halted = summary.Halted || ex.halted[code]
+			payload = append(payload, summary)
+		}
 	}
 
 	return &Message{
@@ -52,109 +137,471 @@ func (ex *Exchange) Broadcast() *Message {
 }
 
 func (ex *Exchange) Buy(
-	code, market string,
-	price, amount float64,
+	account, code, market string,
+	price, amount Decimal,
 ) error {
-	if book, ok := ex.books[code]; ok {
-		if queue := book.GetQueue(market); queue != nil {
-			queue.Add(
-				NewOrder(
-					market,
-					ORDER_TYPE_BID,
-					code,
-					price,
-					amount,
-				),
-			)
-			return nil
-		}
-		return errors.New("Market not exist")
+	o := NewOrder(
+		market,
+		ORDER_TYPE_BID,
+		code,
+		price,
+		amount,
+	)
+	o.Owner = account
+	return ex.Place(o)
+}
+
+func (ex *Exchange) Sell(
+	account, code, market string,
+	price, amount Decimal,
+) error {
+	o := NewOrder(
+		market,
+		ORDER_TYPE_ASK,
+		code,
+		price,
+		amount,
+	)
+	o.Owner = account
+	return ex.Place(o)
+}
+
+// Buy at the best available prices, the slippage bounds how far
+// above the best ask at arrival the order may trade
+func (ex *Exchange) BuyMarket(
+	account, code, market string,
+	amount, slippage Decimal,
+) error {
+	if slippage.IsNegative() {
+		return errors.New("Slippage must not be negative")
 	}
 
-	return errors.New("Stock code not exist")
+	o := NewMarketOrder(
+		market,
+		ORDER_TYPE_BID,
+		code,
+		amount,
+		slippage,
+	)
+	o.Owner = account
+	return ex.Place(o)
 }
 
-func (ex *Exchange) Sell(
-	code, market string,
-	price, amount float64,
+// Sell at the best available prices, the slippage bounds how far
+// below the best bid at arrival the order may trade
+func (ex *Exchange) SellMarket(
+	account, code, market string,
+	amount, slippage Decimal,
 ) error {
-	if book, ok := ex.books[code]; ok {
-		if queue := book.GetQueue(market); queue != nil {
-			queue.Add(
-				NewOrder(
-					market,
-					ORDER_TYPE_ASK,
-					code,
-					price,
-					amount,
-				),
-			)
-			return nil
+	if slippage.IsNegative() {
+		return errors.New("Slippage must not be negative")
+	}
+
+	o := NewMarketOrder(
+		market,
+		ORDER_TYPE_ASK,
+		code,
+		amount,
+		slippage,
+	)
+	o.Owner = account
+	return ex.Place(o)
+}
+
+// Place an order prepared by the caller, e.g. to set its time in force.
+// Every order belongs to the account of its owner and is funded from
+// it. A missing time in force defaults to GTC for limit orders and IOC
+// for market orders
+func (ex *Exchange) Place(o *Order) error {
+	if o.Owner == "" {
+		return errors.New("Order must belong to an account")
+	}
+
+	if o.TimeInForce == "" {
+		if o.IsMarket() {
+			o.TimeInForce = TIME_IN_FORCE_IOC
+		} else {
+			o.TimeInForce = TIME_IN_FORCE_GTC
 		}
-		return errors.New("Market not exist")
 	}
 
-	return errors.New("Stock code not exist")
+	now := ex.now()
+
+	switch o.TimeInForce {
+	case TIME_IN_FORCE_GTC, TIME_IN_FORCE_IOC, TIME_IN_FORCE_FOK:
+		o.ExpireTs = 0
+	case TIME_IN_FORCE_DAY:
+		o.ExpireTs = ex.endOfDay(o.StockCode, now).Unix()
+	case TIME_IN_FORCE_GTD:
+		if o.ExpireTs <= now.Unix() {
+			return errors.New("Expiry must be in the future")
+		}
+	default:
+		return errors.New("Time in force not supported")
+	}
+
+	if o.Slippage.IsNegative() || o.Slippage.GreaterThan(One) {
+		return errors.New("Slippage must be between 0 and 1")
+	}
+
+	if o.IsMarket() && o.TimeInForce != TIME_IN_FORCE_IOC && o.TimeInForce != TIME_IN_FORCE_FOK {
+		return errors.New("Market orders must be IOC or FOK")
+	}
+
+	if o.DisplayAmount.IsNegative() || o.IsIceberg() && o.IsMarket() {
+		return errors.New("Only limit orders may display part of their amount")
+	}
+
+	if o.StopPrice.IsNegative() || o.TrailAmount.IsNegative() || o.TrailPercent.IsNegative() {
+		return errors.New("Stop and trail must not be negative")
+	}
+
+	if o.TrailAmount.IsPositive() && o.TrailPercent.IsPositive() {
+		return errors.New("Trail by either an amount or a percentage")
+	}
+
+	if !o.TrailPercent.LessThan(One) {
+		return errors.New("Trail percentage must be below 1")
+	}
+
+	switch o.PostOnly {
+	case "":
+	case POST_ONLY_REJECT, POST_ONLY_REPRICE:
+		if !o.IsResting() {
+			return errors.New("Post-only orders must be able to rest")
+		}
+	default:
+		return errors.New("Post-only mode not supported")
+	}
+
+	switch o.SelfTrade {
+	case "", SELF_TRADE_CANCEL_NEWEST, SELF_TRADE_CANCEL_OLDEST, SELF_TRADE_CANCEL_BOTH, SELF_TRADE_DECREMENT:
+	default:
+		return errors.New("Self trade prevention not supported")
+	}
+
+	return ex.submit(o)
 }
 
-func (ex *Exchange) Issue(s *Stock, num ...int) error {
+// Cancel a resting order and return it with its remaining amount,
+// when an owner is given only an order placed by them is cancelled
+func (ex *Exchange) Cancel(code, id string, owner ...string) (*Order, error) {
+	var (
+		by string
+	)
 
+	if len(owner) > 0 {
+		by = owner[0]
+	}
+
+	// the broker is never stopped while a request is on its way
+	ex.RLock()
+	defer ex.RUnlock()
+
+	b, ok := ex.owners[code]
+
+	if !ok {
+		return nil, errors.New("Stock code not exist")
+	}
+
+	return b.Cancel(id, by)
+}
+
+// Amend the price and amount of a resting order. Reducing the amount
+// keeps the order's time priority, any other change loses it and a
+// new price that crosses the book trades immediately
+func (ex *Exchange) Amend(code, id string, price, amount Decimal, owner ...string) (*Order, error) {
 	var (
-		count = -1
-		max   = 0
+		by string
 	)
 
-	if len(num) > 0 {
-		max = num[0]
+	if len(owner) > 0 {
+		by = owner[0]
 	}
 
-	ex.stocks[s.Code] = s
-	ex.books[s.Code] = NewBook()
-	// todo: add flexibility to  book type
-	// e.g. BTC_ASK, BTC_BID, ETH_ASK, ETH_BID
+	ex.RLock()
+	defer ex.RUnlock()
 
-	ask := NewQueueAsk()
-	bid := NewQueueBid()
+	stock, b := ex.stocks[code], ex.owners[code]
 
-	ex.books[s.Code].SetQueue("ASK", ask)
-	ex.books[s.Code].SetQueue("BID", bid)
+	if b == nil {
+		return nil, errors.New("Stock code not exist")
+	}
 
-	for _, b := range ex.pool {
-		if b.IsIdle() {
-			b.Watch(ask, bid, ex.books[s.Code].Deals)
-			b.Start()
+	if err := stock.Check(&Order{Price: price, Amount: amount}); err != nil {
+		return nil, err
+	}
 
-			count++
+	if bands := b.Book.Bands(); bands != nil && !bands.Admits(price) {
+		return nil, errors.New("Price is outside the static price band")
+	}
 
-			if count == max {
-				break
-			}
+	if err := ex.admit(code); err != nil {
+		return nil, err
+	}
+
+	return b.Amend(id, by, price, amount)
+}
+
+// Open a call auction for a stock, its orders accumulate without
+// matching and the broadcast carries the indicative uncrossing
+func (ex *Exchange) OpenAuction(code string) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	b, ok := ex.owners[code]
+
+	if !ok {
+		return errors.New("Stock code not exist")
+	}
+
+	return b.Auction()
+}
+
+// Close the call auction of a stock, its markets trade at the price
+// maximising their volume before matching continuously again
+func (ex *Exchange) Uncross(code string) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	b, ok := ex.owners[code]
+
+	if !ok {
+		return errors.New("Stock code not exist")
+	}
+
+	return b.Uncross()
+}
+
+// Configure how crossing orders of a stock are priced
+func (ex *Exchange) SetPricing(code string, rule PricingRule) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if book, ok := ex.books[code]; ok {
+		book.SetPricing(rule)
+		return nil
+	}
+
+	return errors.New("Stock code not exist")
+}
+
+// Configure the fees charged on the deals of a stock
+func (ex *Exchange) SetFees(code string, fees *FeeSchedule) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if err := fees.Check(); err != nil {
+		return err
+	}
+
+	if book, ok := ex.books[code]; ok {
+		book.SetFees(fees)
+		return nil
+	}
+
+	return errors.New("Stock code not exist")
+}
+
+// Keep the trades of a stock within price bands
+func (ex *Exchange) SetBands(code string, bands *PriceBands) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if book, ok := ex.books[code]; ok {
+		book.SetBands(bands)
+		return nil
+	}
+
+	return errors.New("Stock code not exist")
+}
+
+// Limit the price levels broadcast for each side of a stock
+func (ex *Exchange) SetDepth(code string, levels int) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if book, ok := ex.books[code]; ok {
+		book.SetDepth(levels)
+		return nil
+	}
+
+	return errors.New("Stock code not exist")
+}
+
+// Halt the matching of a stock for a while on large price moves
+func (ex *Exchange) SetBreaker(code string, breaker *CircuitBreaker) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if book, ok := ex.books[code]; ok {
+		book.SetBreaker(breaker)
+		return nil
+	}
+
+	return errors.New("Stock code not exist")
+}
+
+// Reserve the funds of the order and hand it over to the broker
+// owning the book. The lock is held until the order is queued so that
+// no halt, delisting or corporate action slips in between
+func (ex *Exchange) submit(o *Order) error {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	stock, book, b := ex.stocks[o.StockCode], ex.books[o.StockCode], ex.owners[o.StockCode]
+
+	if book == nil {
+		return errors.New("Stock code not exist")
+	}
+
+	if err := stock.Check(o); err != nil {
+		return err
+	}
+
+	if o.Type == ORDER_TYPE_ASK && o.Amount.GreaterThan(stock.CirculatingSupply) {
+		return errors.New("Amount exceeds the circulating supply")
+	}
+
+	if bands := book.Bands(); bands != nil && !o.IsMarket() && !bands.Admits(o.Price) {
+		return errors.New("Price is outside the static price band")
+	}
+
+	if book.GetQueue(QueueKey(o.Market, o.Type)) == nil {
+		return errors.New("Market not exist")
+	}
+
+	if b == nil {
+		return errors.New("No broker is serving the stock")
+	}
+
+	if err := ex.admit(o.StockCode); err != nil {
+		return err
+	}
+
+	if !deferred(o) {
+		if err := ex.ledger.Reserve(o); err != nil {
+			return err
 		}
 	}
 
-	if count < 0 {
+	b.Submit(o)
+	return nil
+}
+
+// List a stock with its own orderbook holding a pair of queues for
+// each market of the stock. Exactly one idle broker is attached so
+// that all matching on the book is serialised. The circulating shares
+// are credited to the holders of the allocations, which must add up
+// to the circulating supply
+func (ex *Exchange) Issue(s *Stock, allocations ...*Allocation) error {
+	if len(s.Markets) == 0 {
+		return errors.New("Stock must trade in at least one market")
+	}
+
+	if !s.TotalSupply.IsPositive() {
+		return errors.New("Total supply must be positive")
+	}
+
+	if s.CirculatingSupply.IsNegative() || s.CirculatingSupply.GreaterThan(s.TotalSupply) {
+		return errors.New("Circulating supply must be within the total supply")
+	}
+
+	if allocated, err := allot(allocations); err != nil {
+		return err
+	} else if allocated != s.CirculatingSupply {
+		return errors.New("Allocations must add up to the circulating supply")
+	}
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	if _, ok := ex.stocks[s.Code]; ok {
+		return errors.New("Stock code already exist")
+	}
+
+	var (
+		broker *Broker
+	)
+
+	for _, b := range ex.pool {
+		if b.IsIdle() {
+			broker = b
+			break
+		}
+	}
+
+	if broker == nil {
 		return errors.New("No broker available at the moment, please re-try after a while")
 	}
 
+	book := NewBook(s.Code)
+
+	for _, market := range s.Markets {
+		book.AddMarket(market)
+	}
+
+	ex.stocks[s.Code] = s
+	ex.books[s.Code] = book
+	ex.owners[s.Code] = broker
+
+	quit := make(chan struct{})
+	ex.listeners[s.Code] = quit
+
+	ex.ledger.list(s.Code)
+	ex.credit(s.Code, allocations)
+	ex.account(SUPPLY_ISSUE, s, allocations)
+
+	go book.Listen(quit)
+
+	broker.Watch(s, book)
+	broker.Start()
+
 	return nil
 }
 
+// Stop the exchange, returning once its brokers are stopped
 func (ex *Exchange) Stop() {
 	ex.exit <- true
+	<-ex.done
 }
 
+// Block until the exchange is stopped, brokers and orderbooks
+// are driven by their own events in the meantime
 func (ex *Exchange) Start() {
-	for {
-		select {
-		case <-ex.exit:
-			for _, b := range ex.pool {
-				b.Stop()
-			}
-			return
-		default:
-			for _, b := range ex.books {
-				b.Update()
-			}
-		}
+	go ex.sessions()
+
+	<-ex.exit
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	// stocks are left without a broker so that no request waits on a
+	// stopped one
+	for _, b := range ex.pool {
+		b.Stop()
+	}
+
+	ex.owners = map[string]*Broker{}
+
+	for _, quit := range ex.listeners {
+		close(quit)
 	}
+
+	close(ex.done)
+}
+
+// Orders good for the day expire when the market of the stock closes,
+// a stock without a schedule closes at the next midnight UTC
+func (ex *Exchange) endOfDay(code string, t time.Time) time.Time {
+	ex.RLock()
+	schedule := ex.schedules[code]
+	ex.RUnlock()
+
+	if schedule != nil {
+		return schedule.Close(t)
+	}
+
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
 }
@@ -0,0 +1,433 @@
+package exchange
+
+import (
+	"errors"
+	. "github.com/gravel/models"
+	"sync"
+)
+
+const (
+	// the account collecting the fees of every deal
+	FEE_ACCOUNT = "EXCHANGE_FEES"
+)
+
+// The ledger keeps the balances of every account. Placing an order
+// reserves what it may spend, a fill moves the traded cash and shares
+// between both accounts and whatever an order still holds is released
+// once it leaves the book. Shares of a listed stock are only ever
+// issued and redeemed by the exchange. The total of every asset is kept
+// within the range of a decimal, so that moving it between accounts
+// never overflows a balance
+type Ledger struct {
+	accounts map[string]*Account
+	listed   map[string]bool
+	totals   map[string]Decimal
+	sync.Mutex
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		accounts: map[string]*Account{
+			FEE_ACCOUNT: NewAccount(FEE_ACCOUNT),
+		},
+		listed: map[string]bool{},
+		totals: map[string]Decimal{},
+	}
+}
+
+func (l *Ledger) Open(id string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.accounts[id]; ok {
+		return errors.New("Account already exist")
+	}
+
+	l.accounts[id] = NewAccount(id)
+	return nil
+}
+
+func (l *Ledger) Deposit(id, asset string, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.listed[asset] {
+		return errors.New("Shares of a listed stock cannot be deposited")
+	}
+
+	return l.deposit(id, asset, amount)
+}
+
+func (l *Ledger) Withdraw(id, asset string, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.listed[asset] {
+		return errors.New("Shares of a listed stock cannot be withdrawn")
+	}
+
+	return l.withdraw(id, asset, amount)
+}
+
+// Move available funds of any asset between two accounts, shares of a
+// listed stock included as the supply is left unchanged
+func (l *Ledger) Transfer(from, to, asset string, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.accounts[to]; !ok {
+		return errors.New("Account not exist")
+	}
+
+	if err := l.withdraw(from, asset, amount); err != nil {
+		return err
+	}
+
+	return l.deposit(to, asset, amount)
+}
+
+// Refuse deposits and withdrawals of the shares of a stock from now on
+func (l *Ledger) list(asset string) {
+	l.Lock()
+	defer l.Unlock()
+	l.listed[asset] = true
+}
+
+// Credit an account with new shares of a listed stock, the account is
+// opened if needed
+func (l *Ledger) issue(id, asset string, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.accounts[id]; !ok {
+		l.accounts[id] = NewAccount(id)
+	}
+
+	return l.deposit(id, asset, amount)
+}
+
+// Take shares of a listed stock out of the holder account, paying the
+// holder their price in cash from the issuer account
+func (l *Ledger) redeem(issuer, holder, asset, market string, price, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	value, err := price.CheckedMul(amount)
+
+	if err != nil || !value.IsPositive() {
+		return errors.New("Buyback value is out of range")
+	}
+
+	account, ok := l.accounts[issuer]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	if account.Balance(market).Available.LessThan(value) {
+		return errors.New("Insufficient funds of the issuer")
+	}
+
+	if err := l.withdraw(holder, asset, amount); err != nil {
+		return err
+	}
+
+	l.withdraw(issuer, market, value)
+	return l.deposit(holder, market, value)
+}
+
+// Pay every account its amount of an asset out of the payer account,
+// nothing is paid unless the payer can pay all of them
+func (l *Ledger) pay(payer, asset string, payments map[string]Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	account, ok := l.accounts[payer]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	total := Zero
+
+	for _, amount := range payments {
+		total = total.Add(amount)
+	}
+
+	if account.Balance(asset).Available.LessThan(total) {
+		return errors.New("Insufficient funds of the payer")
+	}
+
+	for id, amount := range payments {
+		if amount.IsPositive() {
+			l.withdraw(payer, asset, amount)
+			l.deposit(id, asset, amount)
+		}
+	}
+
+	return nil
+}
+
+// The caller must hold the lock
+func (l *Ledger) deposit(id, asset string, amount Decimal) error {
+	if !amount.IsPositive() {
+		return errors.New("Amount must be positive")
+	}
+
+	account, ok := l.accounts[id]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	total, err := l.totals[asset].CheckedAdd(amount)
+
+	if err != nil {
+		return errors.New("Amount is out of range")
+	}
+
+	balance := account.Balance(asset)
+	balance.Available = balance.Available.Add(amount)
+	l.totals[asset] = total
+	return nil
+}
+
+// The caller must hold the lock
+func (l *Ledger) withdraw(id, asset string, amount Decimal) error {
+	if !amount.IsPositive() {
+		return errors.New("Amount must be positive")
+	}
+
+	account, ok := l.accounts[id]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	balance := account.Balance(asset)
+
+	if balance.Available.LessThan(amount) {
+		return errors.New("Insufficient funds")
+	}
+
+	balance.Available = balance.Available.Sub(amount)
+	l.totals[asset] = l.totals[asset].Sub(amount)
+	return nil
+}
+
+// Place an account in a fee tier
+func (l *Ledger) SetTier(id, tier string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	account, ok := l.accounts[id]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	account.Tier = tier
+	return nil
+}
+
+// The fee tier of an account, empty for the default tier
+func (l *Ledger) Tier(id string) string {
+	l.Lock()
+	defer l.Unlock()
+
+	if account, ok := l.accounts[id]; ok {
+		return account.Tier
+	}
+	return ""
+}
+
+// What every account holds of an asset, available or held, keyed by
+// account
+func (l *Ledger) Holdings(asset string) map[string]Decimal {
+	l.Lock()
+	defer l.Unlock()
+
+	holdings := map[string]Decimal{}
+
+	for id, account := range l.accounts {
+		if b, ok := account.Balances[asset]; ok && b.Total().IsPositive() {
+			holdings[id] = b.Total()
+		}
+	}
+
+	return holdings
+}
+
+// Rescale every position of an asset for a split giving to new shares
+// for every from shares. Positions are rounded down to the step, the
+// fractions left over are dropped, and each account holds what its
+// orders hold once rescaled. It returns the total left
+func (l *Ledger) Split(asset string, from, to int64, step Decimal, held map[string]Decimal) Decimal {
+	l.Lock()
+	defer l.Unlock()
+
+	total := Zero
+
+	for id, account := range l.accounts {
+		if b, ok := account.Balances[asset]; ok {
+			position, _ := b.Total().Scale(to, from)
+			position = position.Truncate(step)
+
+			b.Held = held[id]
+			b.Available = position.Sub(b.Held)
+			total = total.Add(position)
+		}
+	}
+
+	l.totals[asset] = total
+	return total
+}
+
+// A copy of the balance of an asset in an account
+func (l *Ledger) Balance(id, asset string) (Balance, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	account, ok := l.accounts[id]
+
+	if !ok {
+		return Balance{}, errors.New("Account not exist")
+	}
+
+	return *account.Balance(asset), nil
+}
+
+// Hold what the order may spend, a market bid has no price so it
+// holds all the available cash until it has traded
+func (l *Ledger) Reserve(o *Order) error {
+	l.Lock()
+	defer l.Unlock()
+
+	account, ok := l.accounts[o.Owner]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	var (
+		balance = account.Balance(o.Asset())
+		amount  = o.Amount
+	)
+
+	if o.Type == ORDER_TYPE_BID {
+		if o.IsMarket() {
+			amount = balance.Available
+		} else {
+			amount = o.Price.Mul(o.Amount)
+		}
+	}
+
+	if !amount.IsPositive() || balance.Available.LessThan(amount) {
+		return errors.New("Insufficient funds")
+	}
+
+	balance.Available = balance.Available.Sub(amount)
+	balance.Held = balance.Held.Add(amount)
+	o.Reserved = o.Reserved.Add(amount)
+	return nil
+}
+
+// A market bid cannot tell what it may spend until it trades, it only
+// holds the available cash once the broker executes it or, for a stop
+// market bid, once triggered
+func deferred(o *Order) bool {
+	return o.IsMarket() && o.Type == ORDER_TYPE_BID
+}
+
+// Hold what the order needs at a new price and amount, releasing
+// the excess or holding the difference
+func (l *Ledger) Rehold(o *Order, price, amount Decimal) error {
+	l.Lock()
+	defer l.Unlock()
+
+	account, ok := l.accounts[o.Owner]
+
+	if !ok {
+		return errors.New("Account not exist")
+	}
+
+	var (
+		balance  = account.Balance(o.Asset())
+		required = amount
+	)
+
+	if o.Type == ORDER_TYPE_BID {
+		required = price.Mul(amount)
+	}
+
+	diff := required.Sub(o.Reserved)
+
+	if balance.Available.LessThan(diff) {
+		return errors.New("Insufficient funds")
+	}
+
+	balance.Available = balance.Available.Sub(diff)
+	balance.Held = balance.Held.Add(diff)
+	o.Reserved = required
+	return nil
+}
+
+// Give back whatever the order still holds
+func (l *Ledger) Release(o *Order) {
+	l.Lock()
+	defer l.Unlock()
+
+	if account, ok := l.accounts[o.Owner]; ok && o.Reserved.IsPositive() {
+		balance := account.Balance(o.Asset())
+		balance.Held = balance.Held.Sub(o.Reserved)
+		balance.Available = balance.Available.Add(o.Reserved)
+	}
+
+	o.Reserved = Zero
+}
+
+// Move the traded shares from the seller to the buyer and the cash
+// the other way round, both out of what the orders hold. The fees of
+// the deal are kept from what each side receives and credited to the
+// fee account, which also pays the rebates
+func (l *Ledger) Settle(ask, bid *Order, deal *Deal) {
+	l.Lock()
+	defer l.Unlock()
+
+	var (
+		seller         = l.accounts[ask.Owner]
+		buyer          = l.accounts[bid.Owner]
+		house          = l.accounts[FEE_ACCOUNT]
+		askFee, bidFee = deal.Fees()
+	)
+
+	if seller == nil || buyer == nil {
+		return
+	}
+
+	// rebates are paid out of the fees collected so far, a side is
+	// paid no more than the fee account holds
+	askFee = rebate(house.Balance(bid.Asset()), askFee)
+	bidFee = rebate(house.Balance(ask.Asset()), bidFee)
+	deal.SetFees(askFee, bidFee)
+
+	shares := seller.Balance(ask.Asset())
+	shares.Held = shares.Held.Sub(deal.Amount)
+	ask.Reserved = ask.Reserved.Sub(deal.Amount)
+	credit(buyer.Balance(ask.Asset()), deal.Amount.Sub(bidFee))
+	credit(house.Balance(ask.Asset()), bidFee)
+
+	cash := buyer.Balance(bid.Asset())
+	cash.Held = cash.Held.Sub(deal.Total)
+	bid.Reserved = bid.Reserved.Sub(deal.Total)
+	credit(seller.Balance(bid.Asset()), deal.Total.Sub(askFee))
+	credit(house.Balance(bid.Asset()), askFee)
+}
+
+func rebate(house *Balance, fee Decimal) Decimal {
+	return MaxDecimal(fee, house.Available.Neg())
+}
+
+func credit(balance *Balance, amount Decimal) {
+	balance.Available = balance.Available.Add(amount)
+}
@@ -0,0 +1,127 @@
+package exchange
+
+import (
+	"errors"
+	. "github.com/gravel/models"
+	"time"
+)
+
+// Replace the clock the trading sessions and the expiries of orders
+// follow
+func (ex *Exchange) SetClock(clock Clock) {
+	ex.clock.Store(clock)
+}
+
+// The time of the clock, safe to read without the lock
+func (ex *Exchange) now() time.Time {
+	return ex.clock.Load().(Clock)()
+}
+
+// Trade a stock in the sessions of a schedule, a stock without a
+// schedule trades continuously
+func (ex *Exchange) SetSchedule(code string, s *Schedule) error {
+	ex.Lock()
+
+	if _, ok := ex.books[code]; !ok {
+		ex.Unlock()
+		return errors.New("Stock code not exist")
+	}
+
+	ex.schedules[code] = s
+	ex.Unlock()
+
+	ex.Tick()
+	return nil
+}
+
+// The current trading phase of a stock
+func (ex *Exchange) Phase(code string) (string, error) {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if _, ok := ex.books[code]; !ok {
+		return "", errors.New("Stock code not exist")
+	}
+
+	return ex.phase(code), nil
+}
+
+// Move every stock into the phase its schedule gives at the time of
+// the clock. Entering a pre-open or auction phase queues the orders,
+// leaving it uncrosses them. Every transition is published as an event.
+// Corporate actions are processed once their record date has come
+func (ex *Exchange) Tick() {
+	var (
+		changed = map[string]string{}
+	)
+
+	ex.Lock()
+
+	now := ex.now()
+
+	for code, schedule := range ex.schedules {
+		if phase := schedule.Phase(now); phase != ex.phase(code) {
+			ex.phases[code] = phase
+			changed[code] = phase
+		}
+	}
+
+	ex.Unlock()
+
+	for code, phase := range changed {
+		ex.RLock()
+		stock, book, b := ex.stocks[code], ex.books[code], ex.owners[code]
+
+		// the stock may have been delisted meanwhile
+		if book != nil && b != nil {
+			if IsAuctionPhase(phase) && !book.InAuction() {
+				b.Auction()
+			} else if !IsAuctionPhase(phase) && book.InAuction() {
+				b.Uncross()
+			}
+
+			ex.publish(NewPhaseMessage(stock, phase))
+		}
+
+		ex.RUnlock()
+	}
+
+	ex.process()
+}
+
+// Follow the clock until the exchange stops
+func (ex *Exchange) sessions() {
+	ticker := time.NewTicker(SESSION_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ex.Tick()
+		case <-ex.done:
+			return
+		}
+	}
+}
+
+// The caller must hold the lock
+func (ex *Exchange) phase(code string) string {
+	if phase, ok := ex.phases[code]; ok {
+		return phase
+	}
+	return PHASE_CONTINUOUS
+}
+
+// Orders are refused while the market of the stock is closed or an
+// operator halted the stock. The caller must hold the lock until the
+// order is queued
+func (ex *Exchange) admit(code string) error {
+	if ex.halted[code] {
+		return errors.New("Stock is halted")
+	}
+
+	if ex.phase(code) == PHASE_CLOSED {
+		return errors.New("Market is closed")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package exchange
+
+import (
+	"errors"
+	. "github.com/gravel/models"
+)
+
+// Issue new shares of a listed stock to the holders of the allocations,
+// both the total and the circulating supply grow by the shares issued
+func (ex *Exchange) Offer(code string, allocations ...*Allocation) error {
+	amount, err := allot(allocations)
+
+	if err != nil {
+		return err
+	}
+
+	if !amount.IsPositive() {
+		return errors.New("Nothing to issue")
+	}
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, ok := ex.stocks[code]
+
+	if !ok {
+		return errors.New("Stock code not exist")
+	}
+
+	supply, err := stock.TotalSupply.CheckedAdd(amount)
+
+	if err != nil {
+		return errors.New("Offering is out of range for the supply")
+	}
+
+	updated := *stock
+	updated.TotalSupply = supply
+	updated.CirculatingSupply = updated.CirculatingSupply.Add(amount)
+	ex.restock(&updated)
+
+	ex.credit(code, allocations)
+	ex.account(SUPPLY_OFFERING, &updated, allocations)
+	return nil
+}
+
+// Buy shares of a stock back from a holder at a price paid in a market
+// of the stock by the issuer account. The shares leave circulation but
+// remain part of the total supply
+func (ex *Exchange) Buyback(code, market, issuer, holder string, price, amount Decimal) error {
+	if !price.IsPositive() {
+		return errors.New("Price must be positive")
+	}
+
+	ex.Lock()
+	defer ex.Unlock()
+
+	stock, ok := ex.stocks[code]
+
+	if !ok {
+		return errors.New("Stock code not exist")
+	}
+
+	if ex.books[code].GetQueue(QueueKey(market, ORDER_TYPE_BID)) == nil {
+		return errors.New("Market not exist")
+	}
+
+	if amount.GreaterThan(stock.CirculatingSupply) {
+		return errors.New("Amount exceeds the circulating supply")
+	}
+
+	if err := ex.ledger.redeem(issuer, holder, code, market, price, amount); err != nil {
+		return err
+	}
+
+	updated := *stock
+	updated.CirculatingSupply = updated.CirculatingSupply.Sub(amount)
+	ex.restock(&updated)
+
+	ex.account(SUPPLY_BUYBACK, &updated, []*Allocation{NewAllocation(holder, amount)})
+	return nil
+}
+
+// The changes in the shares of a stock, oldest first
+func (ex *Exchange) Supply(code string) ([]*SupplyEvent, error) {
+	ex.RLock()
+	defer ex.RUnlock()
+
+	if events, ok := ex.supply[code]; ok {
+		return append([]*SupplyEvent{}, events...), nil
+	}
+
+	return nil, errors.New("Stock code not exist")
+}
+
+// The shares the allocations add up to, each must be positive
+func allot(allocations []*Allocation) (Decimal, error) {
+	var total Decimal
+
+	for _, a := range allocations {
+		if !a.Amount.IsPositive() {
+			return Zero, errors.New("Allocated amount must be positive")
+		}
+
+		sum, err := total.CheckedAdd(a.Amount)
+
+		if err != nil {
+			return Zero, errors.New("Allocated amount is out of range")
+		}
+
+		total = sum
+	}
+
+	return total, nil
+}
+
+// Credit the holders with their shares, opening their accounts if
+// needed. The caller must hold the lock
+func (ex *Exchange) credit(code string, allocations []*Allocation) {
+	for _, a := range allocations {
+		ex.ledger.issue(a.AccountId, code, a.Amount)
+	}
+}
+
+// Replace a stock for the exchange and the broker serving it, stocks
+// are replaced rather than modified as orders are checked against them
+// without holding the lock. The caller must hold the lock
+func (ex *Exchange) restock(s *Stock) {
+	ex.stocks[s.Code] = s
+
+	if b := ex.owners[s.Code]; b != nil {
+		b.Apply(func() {
+			b.Stock = s
+		})
+	}
+}
+
+// Record a change in the supply of a stock. The caller must hold the lock
+func (ex *Exchange) account(kind string, s *Stock, allocations []*Allocation) {
+	ex.supply[s.Code] = append(ex.supply[s.Code], &SupplyEvent{
+		Kind:              kind,
+		StockCode:         s.Code,
+		Allocations:       allocations,
+		TotalSupply:       s.TotalSupply,
+		CirculatingSupply: s.CirculatingSupply,
+		Timestamp:         ex.now().Unix(),
+	})
+}
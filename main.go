@@ -6,6 +6,7 @@ import (
 	. "github.com/gravel/app"
 	. "github.com/gravel/exchange"
 	. "github.com/gravel/models"
+	"github.com/satori/go.uuid"
 	"net/http"
 	"os"
 	"time"
@@ -29,6 +30,17 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Messages queued for a client while its connection is busy.
+	sendBufferSize = 256
+
+	// Funds of the demo account every client trades from.
+	DEMO_STOCK  = "STK"
+	DEMO_CASH   = 1000000
+	DEMO_SHARES = 1000
+
+	// Holder of the circulating shares the demo stock is listed with.
+	DEMO_ISSUER = "demo-issuer"
 )
 
 func main() {
@@ -39,8 +51,6 @@ func main() {
 		TOTAL       = 100000
 		CIRCULATING = 90000
 		REF         = "/stocks/stk"
-		MARKET_ASK  = "ASK"
-		MARKET_BID  = "BID"
 	)
 
 	var (
@@ -48,8 +58,8 @@ func main() {
 			NAME,
 			CODE,
 			DESCRIPTION,
-			TOTAL,
-			CIRCULATING,
+			NewDecimalFromInt(TOTAL),
+			NewDecimalFromInt(CIRCULATING),
 			REF,
 		)
 		hub = newHub()
@@ -61,7 +71,7 @@ func main() {
 
 	go exchange.Start()
 
-	exchange.Issue(stock)
+	exchange.Issue(stock, NewAllocation(DEMO_ISSUER, NewDecimalFromInt(CIRCULATING)))
 
 	go hub.run()
 
@@ -94,6 +104,14 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Outbound messages for a single client.
+	replies chan *reply
+}
+
+type reply struct {
+	client  *Client
+	message *Message
 }
 
 func newHub() *Hub {
@@ -101,6 +119,7 @@ func newHub() *Hub {
 		broadcast:  make(chan *Message),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		replies:    make(chan *reply),
 		clients:    make(map[*Client]bool),
 	}
 }
@@ -125,6 +144,22 @@ func (h *Hub) run() {
 				close(client.send)
 			}
 			fmt.Println("Hub", "unregister")
+		// replies, notices and events are dropped for a client whose
+		// queue is full rather than closing its connection
+		case r := <-h.replies:
+			if _, ok := h.clients[r.client]; ok {
+				r.client.offer(r.message)
+			}
+		case notice := <-exchange.Notices():
+			for client := range h.clients {
+				if client.id == notice.Order.Owner {
+					client.offer(notice)
+				}
+			}
+		case event := <-exchange.Events():
+			for client := range h.clients {
+				client.offer(event)
+			}
 		case message := <-h.broadcast:
 			fmt.Println("Hub", "broadcast")
 			for client := range h.clients {
@@ -140,11 +175,60 @@ func (h *Hub) run() {
 }
 
 type Client struct {
+	id   string
 	hub  *Hub
 	conn *websocket.Conn
 	send chan *Message
 }
 
+// Send a message to this client only, the hub owns the send channel
+func (c *Client) reply(msg *Message) {
+	c.hub.replies <- &reply{client: c, message: msg}
+}
+
+// Queue a message unless the client lags behind, only the hub may call it
+func (c *Client) offer(msg *Message) {
+	select {
+	case c.send <- msg:
+	default:
+	}
+}
+
+// Build a fresh order owned by the client from the one it sent,
+// ids and timestamps chosen by the client are never trusted
+func (c *Client) order(tp string, o *Order) *Order {
+	var (
+		order  *Order
+		market = o.Market
+	)
+
+	// the bundled web app sends the order side in place of the market
+	if market == ORDER_TYPE_ASK || market == ORDER_TYPE_BID {
+		market = DEFAULT_MARKET
+	}
+
+	if o.IsMarket() {
+		order = NewMarketOrder(market, tp, o.StockCode, o.Amount, o.Slippage)
+	} else {
+		order = NewOrder(market, tp, o.StockCode, o.Price, o.Amount)
+	}
+
+	if o.TimeInForce != "" {
+		order.TimeInForce = o.TimeInForce
+	}
+
+	order.ExpireTs = o.ExpireTs
+	order.DisplayAmount = o.DisplayAmount
+	order.StopPrice = o.StopPrice
+	order.TrailAmount = o.TrailAmount
+	order.TrailPercent = o.TrailPercent
+	order.PostOnly = o.PostOnly
+	order.Hidden = o.Hidden
+	order.SelfTrade = o.SelfTrade
+	order.Owner = c.id
+	return order
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
@@ -172,22 +256,32 @@ func (c *Client) readPump() {
 		case MESSAGE_COMMAND_CLOSE:
 			return
 		case MESSAGE_COMMAND_BUY:
-			if err := exchange.Buy(
+			if err := exchange.Place(c.order(ORDER_TYPE_BID, message.Order)); err != nil {
+				c.reply(NewErrorMessage(err.Error()))
+			}
+		case MESSAGE_COMMAND_SELL:
+			if err := exchange.Place(c.order(ORDER_TYPE_ASK, message.Order)); err != nil {
+				c.reply(NewErrorMessage(err.Error()))
+			}
+		case MESSAGE_COMMAND_CANCEL:
+			// the cancelled order is delivered as a notice to its owner
+			if _, err := exchange.Cancel(
 				message.Order.StockCode,
-				message.Order.Market,
-				message.Order.Price,
-				message.Order.Amount,
+				message.Order.OrderId,
+				c.id,
 			); err != nil {
-				panic(err)
+				c.reply(NewErrorMessage(err.Error()))
 			}
-		case MESSAGE_COMMAND_SELL:
-			if err := exchange.Sell(
+		case MESSAGE_COMMAND_AMEND:
+			// the amended order is delivered as a notice to its owner
+			if _, err := exchange.Amend(
 				message.Order.StockCode,
-				message.Order.Market,
+				message.Order.OrderId,
 				message.Order.Price,
 				message.Order.Amount,
+				c.id,
 			); err != nil {
-				panic(err)
+				c.reply(NewErrorMessage(err.Error()))
 			}
 		case MESSAGE_COMMAND_NEW_STOCK:
 			continue
@@ -235,7 +329,15 @@ func serve(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan *Message)}
+	client := &Client{id: uuid.NewV4().String(), hub: hub, conn: conn, send: make(chan *Message, sendBufferSize)}
+
+	// every client trades from a demo account funded on connection, its
+	// shares come from the pool of the issuer so the supply never grows
+	// and late clients get none once the pool is exhausted
+	exchange.Ledger().Open(client.id)
+	exchange.Ledger().Deposit(client.id, DEFAULT_MARKET, NewDecimalFromInt(DEMO_CASH))
+	exchange.Ledger().Transfer(DEMO_ISSUER, client.id, DEMO_STOCK, NewDecimalFromInt(DEMO_SHARES))
+
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,39 @@
+package models
+
+// A balance of one asset, held funds are reserved by resting orders
+// and cannot be spent elsewhere until released
+type Balance struct {
+	Available Decimal `json:"available"`
+	Held      Decimal `json:"held"`
+}
+
+func (b *Balance) Total() Decimal {
+	return b.Available.Add(b.Held)
+}
+
+// An account holds cash in each market currency and shares of each
+// stock, keyed by currency or stock code. The tier of the account
+// decides the fees it pays
+type Account struct {
+	AccountId string              `json:"account_id"`
+	Tier      string              `json:"tier"`
+	Balances  map[string]*Balance `json:"balances"`
+}
+
+func NewAccount(id string) *Account {
+	return &Account{
+		AccountId: id,
+		Balances:  map[string]*Balance{},
+	}
+}
+
+// The balance of an asset, created empty on first use
+func (a *Account) Balance(asset string) *Balance {
+	if b, ok := a.Balances[asset]; ok {
+		return b
+	}
+
+	b := &Balance{}
+	a.Balances[asset] = b
+	return b
+}
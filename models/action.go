@@ -0,0 +1,26 @@
+package models
+
+const (
+	ACTION_SPLIT          = "SPLIT"
+	ACTION_CASH_DIVIDEND  = "CASH_DIVIDEND"
+	ACTION_STOCK_DIVIDEND = "STOCK_DIVIDEND"
+)
+
+// A corporate action adjusts a listed stock. A split gives To new
+// shares for every From shares, fewer for a reverse split. A dividend
+// pays Ratio per share held on the record date, in the currency out of
+// the Payer account for a cash dividend and in shares of the stock for
+// a stock dividend
+type CorporateAction struct {
+	Kind      string  `json:"kind"`
+	StockCode string  `json:"stock_code"`
+	From      int64   `json:"from,omitempty"`
+	To        int64   `json:"to,omitempty"`
+	Ratio     Decimal `json:"ratio"`
+	Currency  string  `json:"currency"`
+	Payer     string  `json:"payer,omitempty"`
+	RecordTs  int64   `json:"record_ts"`
+	Processed bool    `json:"processed"`
+	// why a processed action could not be applied, empty once applied
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,90 @@
+package models
+
+// The outcome of uncrossing a market in a call auction, while the
+// auction is open it is the indicative price and volume
+type Auction struct {
+	Price  Decimal `json:"price"`
+	Volume Decimal `json:"volume"`
+}
+
+// Find the single price at which the queues of a market trade the
+// largest volume. Ties go to the price leaving the smallest surplus,
+// then to the price nearest the reference (e.g. the last trade price)
+// and finally to the lowest price
+func Equilibrium(ask, bid OrderQueue, reference Decimal) *Auction {
+	var (
+		best    = &Auction{}
+		surplus Decimal
+		prices  = map[Decimal]bool{}
+	)
+
+	for _, queue := range []OrderQueue{ask, bid} {
+		queue.Range(func(o *Order) bool {
+			prices[o.Price] = true
+			return true
+		})
+	}
+
+	for price := range prices {
+		var demand, supply Decimal
+
+		bid.Range(func(o *Order) bool {
+			if o.Price.LessThan(price) {
+				return false
+			}
+			demand = demand.Add(o.Remaining())
+			return true
+		})
+
+		ask.Range(func(o *Order) bool {
+			if o.Price.GreaterThan(price) {
+				return false
+			}
+			supply = supply.Add(o.Remaining())
+			return true
+		})
+
+		var (
+			volume = MinDecimal(demand, supply)
+			left   = MaxDecimal(demand, supply).Sub(volume)
+		)
+
+		if !volume.IsPositive() {
+			continue
+		}
+
+		if better(volume, left, price, best.Volume, surplus, best.Price, reference) {
+			best.Price, best.Volume, surplus = price, volume, left
+		}
+	}
+
+	return best
+}
+
+// Whether an uncrossing price beats the best one found so far
+func better(volume, surplus, price, bestVolume, bestSurplus, bestPrice, reference Decimal) bool {
+	if bestVolume.IsZero() || volume != bestVolume {
+		return volume.GreaterThan(bestVolume)
+	}
+
+	if surplus != bestSurplus {
+		return surplus.LessThan(bestSurplus)
+	}
+
+	if reference.IsPositive() {
+		gap, bestGap := distance(price, reference), distance(bestPrice, reference)
+
+		if gap != bestGap {
+			return gap.LessThan(bestGap)
+		}
+	}
+
+	return price.LessThan(bestPrice)
+}
+
+func distance(a, b Decimal) Decimal {
+	if a.LessThan(b) {
+		return b.Sub(a)
+	}
+	return a.Sub(b)
+}
@@ -0,0 +1,15 @@
+package models
+
+const (
+	AUDIT_ACTION_HALT   = "HALT"
+	AUDIT_ACTION_RESUME = "RESUME"
+	AUDIT_ACTION_DELIST = "DELIST"
+)
+
+// An audit entry records an administrative operation on a stock
+type AuditEntry struct {
+	Action    string `json:"action"`
+	StockCode string `json:"stock_code"`
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
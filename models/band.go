@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+)
+
+// Price bands keep trades near a reference price, each band is a
+// fraction of its reference and zero leaves it open. The static band
+// is centred on a fixed reference, e.g. the previous close, and the
+// dynamic band on the last trade price of the market
+type PriceBands struct {
+	Reference Decimal `json:"reference"`
+	Static    Decimal `json:"static"`
+	Dynamic   Decimal `json:"dynamic"`
+}
+
+// Whether the price lies within the static band
+func (pb *PriceBands) Admits(price Decimal) bool {
+	return within(price, pb.Reference, pb.Static)
+}
+
+// Whether a trade may happen at the price given the last trade price
+func (pb *PriceBands) Allows(price, last Decimal) bool {
+	return pb.Admits(price) && within(price, last, pb.Dynamic)
+}
+
+// A circuit breaker halts the matching of a stock for a period when a
+// trade moves the price by more than the threshold, a fraction of the
+// last trade price
+type CircuitBreaker struct {
+	Threshold Decimal       `json:"threshold"`
+	Period    time.Duration `json:"period"`
+}
+
+// Whether a trade at the price moves too far from the last trade price
+func (cb *CircuitBreaker) Trips(price, last Decimal) bool {
+	return !within(price, last, cb.Threshold)
+}
+
+func within(price, reference, band Decimal) bool {
+	if !band.IsPositive() || !reference.IsPositive() {
+		return true
+	}
+	return !distance(price, reference).GreaterThan(reference.Mul(band))
+}
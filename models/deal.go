@@ -1,21 +1,78 @@
 package models
 
 import (
+	"github.com/satori/go.uuid"
 	"time"
 )
 
+// A deal records a trade between a resting (maker) order
+// and the incoming (taker) order that crossed it. Each side
+// pays its fee in the asset it receives: the seller in the
+// market currency and the buyer in shares of the stock
 type Deal struct {
-	Price     float64 `json:"price"`
-	Amount    float64 `json:"amount"`
-	Total     float64 `json:"total"`
-	Timestamp int64   `json:"timestamp"`
+	TradeId    string  `json:"trade_id"`
+	StockCode  string  `json:"stock_code"`
+	Market     string  `json:"market"`
+	AskOrderId string  `json:"ask_order_id"`
+	BidOrderId string  `json:"bid_order_id"`
+	Maker      string  `json:"maker"`
+	Taker      string  `json:"taker"`
+	Price      Decimal `json:"price"`
+	Amount     Decimal `json:"amount"`
+	Total      Decimal `json:"total"`
+	MakerFee   Decimal `json:"maker_fee"`
+	TakerFee   Decimal `json:"taker_fee"`
+	Timestamp  int64   `json:"timestamp"`
 }
 
-func NewDeal(price, amount float64) *Deal {
-	return &Deal{
+func NewDeal(maker, taker *Order, price, amount Decimal) *Deal {
+	deal := &Deal{
+		TradeId:   uuid.NewV4().String(),
+		StockCode: taker.StockCode,
+		Market:    taker.Market,
+		Maker:     maker.Type,
+		Taker:     taker.Type,
 		Price:     price,
 		Amount:    amount,
-		Total:     price * amount,
+		Total:     price.Mul(amount),
 		Timestamp: time.Now().Unix(),
 	}
+
+	if taker.Type == ORDER_TYPE_ASK {
+		deal.AskOrderId, deal.BidOrderId = taker.OrderId, maker.OrderId
+	} else {
+		deal.AskOrderId, deal.BidOrderId = maker.OrderId, taker.OrderId
+	}
+
+	return deal
+}
+
+// Charge the maker and the taker their fee rates on what they receive
+func (d *Deal) Charge(maker, taker Decimal) {
+	d.MakerFee = d.received(d.Maker).Mul(maker)
+	d.TakerFee = d.received(d.Taker).Mul(taker)
+}
+
+// The fees paid by the seller and the buyer
+func (d *Deal) Fees() (ask, bid Decimal) {
+	if d.Maker == ORDER_TYPE_ASK {
+		return d.MakerFee, d.TakerFee
+	}
+	return d.TakerFee, d.MakerFee
+}
+
+// Record the fees actually paid by the seller and the buyer
+func (d *Deal) SetFees(ask, bid Decimal) {
+	if d.Maker == ORDER_TYPE_ASK {
+		d.MakerFee, d.TakerFee = ask, bid
+	} else {
+		d.MakerFee, d.TakerFee = bid, ask
+	}
+}
+
+func (d *Deal) received(side string) Decimal {
+	if side == ORDER_TYPE_ASK {
+		return d.Total
+	}
+	return d.Amount
 }
@@ -0,0 +1,341 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	// number of decimal places every price and quantity is stored with
+	DECIMAL_PLACES = 8
+	decimalScale   = 100000000
+)
+
+// A fixed-point decimal number used for prices and quantities so that
+// repeated arithmetic never accumulates binary rounding errors. Values
+// are stored as an integer count of 10^-DECIMAL_PLACES units, the zero
+// value is 0 and two decimals of equal value compare equal with ==
+type Decimal struct {
+	value int64
+}
+
+var (
+	Zero = Decimal{}
+	One  = NewDecimalFromInt(1)
+)
+
+// Convert a float, rounding to the nearest representable decimal
+func NewDecimal(f float64) Decimal {
+	return Decimal{int64(math.Round(f * decimalScale))}
+}
+
+// An integer out of range panics
+func NewDecimalFromInt(i int64) Decimal {
+	if i > math.MaxInt64/decimalScale || i < math.MinInt64/decimalScale {
+		panic(errors.New("Decimal overflow"))
+	}
+	return Decimal{i * decimalScale}
+}
+
+// Parse a decimal exactly, e.g. "10.25" or "1e-7", a value with more
+// than DECIMAL_PLACES decimal places is rejected instead of rounded
+func ParseDecimal(s string) (Decimal, error) {
+	if strings.ContainsAny(s, "/") {
+		return Zero, errors.New("Invalid decimal " + s)
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+
+	if !ok {
+		return Zero, errors.New("Invalid decimal " + s)
+	}
+
+	r.Mul(r, new(big.Rat).SetInt64(decimalScale))
+
+	if !r.IsInt() {
+		return Zero, errors.New("Decimal " + s + " has too many decimal places")
+	}
+
+	if !r.Num().IsInt64() {
+		return Zero, errors.New("Decimal " + s + " is out of range")
+	}
+
+	return Decimal{r.Num().Int64()}, nil
+}
+
+// A sum out of range panics, CheckedAdd reports it instead
+func (d Decimal) Add(o Decimal) Decimal {
+	return must(d.CheckedAdd(o))
+}
+
+// A difference out of range panics, CheckedSub reports it instead
+func (d Decimal) Sub(o Decimal) Decimal {
+	return must(d.CheckedSub(o))
+}
+
+// Add, failing when the sum is out of range
+func (d Decimal) CheckedAdd(o Decimal) (Decimal, error) {
+	sum := d.value + o.value
+
+	if (sum > d.value) != (o.value > 0) {
+		return Zero, errors.New("Decimal overflow")
+	}
+
+	return Decimal{sum}, nil
+}
+
+// Subtract, failing when the difference is out of range
+func (d Decimal) CheckedSub(o Decimal) (Decimal, error) {
+	difference := d.value - o.value
+
+	if (difference < d.value) != (o.value > 0) {
+		return Zero, errors.New("Decimal overflow")
+	}
+
+	return Decimal{difference}, nil
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{-d.value}
+}
+
+// Multiply, rounding half away from zero to DECIMAL_PLACES. A product
+// out of range panics, CheckedMul reports it instead
+func (d Decimal) Mul(o Decimal) Decimal {
+	return must(d.CheckedMul(o))
+}
+
+// Divide, rounding half away from zero to DECIMAL_PLACES. A quotient
+// out of range panics, CheckedDiv reports it instead
+func (d Decimal) Div(o Decimal) Decimal {
+	if o.value == 0 {
+		panic("decimal division by zero")
+	}
+
+	return must(d.CheckedDiv(o))
+}
+
+// Multiply, failing when the product is out of range
+func (d Decimal) CheckedMul(o Decimal) (Decimal, error) {
+	hi, lo := bits.Mul64(abs(d.value), abs(o.value))
+
+	if hi >= decimalScale {
+		return Zero, errors.New("Decimal overflow")
+	}
+
+	q, r := bits.Div64(hi, lo, decimalScale)
+
+	if r*2 >= decimalScale {
+		q++
+	}
+
+	return signed(q, d.value < 0 != (o.value < 0))
+}
+
+// Divide, failing when the quotient is out of range or the divisor
+// is zero
+func (d Decimal) CheckedDiv(o Decimal) (Decimal, error) {
+	if o.value == 0 {
+		return Zero, errors.New("Decimal division by zero")
+	}
+
+	hi, lo := bits.Mul64(abs(d.value), decimalScale)
+
+	if hi >= abs(o.value) {
+		return Zero, errors.New("Decimal overflow")
+	}
+
+	q, r := bits.Div64(hi, lo, abs(o.value))
+
+	if r*2 >= abs(o.value) {
+		q++
+	}
+
+	return signed(q, d.value < 0 != (o.value < 0))
+}
+
+// Multiply by the fraction num/den of two positive integers, rounding
+// towards zero. It fails when the result is out of range
+func (d Decimal) Scale(num, den int64) (Decimal, error) {
+	if num <= 0 || den <= 0 {
+		return Zero, errors.New("Decimal scale must be positive")
+	}
+
+	hi, lo := bits.Mul64(abs(d.value), uint64(num))
+
+	if hi >= uint64(den) {
+		return Zero, errors.New("Decimal overflow")
+	}
+
+	q, _ := bits.Div64(hi, lo, uint64(den))
+	return signed(q, d.value < 0)
+}
+
+// Round half away from zero to the given number of decimal places
+func (d Decimal) Round(places int) Decimal {
+	if places >= DECIMAL_PLACES {
+		return d
+	}
+
+	unit := int64(math.Pow10(DECIMAL_PLACES - places))
+	q, r := d.value/unit, d.value%unit
+
+	if r*2 >= unit {
+		q++
+	} else if r*2 <= -unit {
+		q--
+	}
+
+	return Decimal{q * unit}
+}
+
+// Round towards zero to a multiple of step
+func (d Decimal) Truncate(step Decimal) Decimal {
+	if step.value <= 0 {
+		return d
+	}
+	return Decimal{d.value / step.value * step.value}
+}
+
+// Whether the decimal is a whole multiple of step
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	return step.value <= 0 || d.value%step.value == 0
+}
+
+// The number of significant decimal places
+func (d Decimal) Places() int {
+	places := DECIMAL_PLACES
+
+	for v := d.value; places > 0 && v%10 == 0; v /= 10 {
+		places--
+	}
+
+	return places
+}
+
+func (d Decimal) Cmp(o Decimal) int {
+	switch {
+	case d.value < o.value:
+		return -1
+	case d.value > o.value:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) LessThan(o Decimal) bool {
+	return d.value < o.value
+}
+
+func (d Decimal) GreaterThan(o Decimal) bool {
+	return d.value > o.value
+}
+
+func (d Decimal) IsZero() bool {
+	return d.value == 0
+}
+
+func (d Decimal) IsPositive() bool {
+	return d.value > 0
+}
+
+func (d Decimal) IsNegative() bool {
+	return d.value < 0
+}
+
+func MinDecimal(a, b Decimal) Decimal {
+	if a.value <= b.value {
+		return a
+	}
+	return b
+}
+
+func MaxDecimal(a, b Decimal) Decimal {
+	if a.value >= b.value {
+		return a
+	}
+	return b
+}
+
+// An approximation for display and statistics, never for arithmetic
+func (d Decimal) Float64() float64 {
+	return float64(d.value) / decimalScale
+}
+
+func (d Decimal) String() string {
+	var (
+		digits = strconv.FormatUint(abs(d.value), 10)
+		sign   = ""
+	)
+
+	if d.value < 0 {
+		sign = "-"
+	}
+
+	if len(digits) <= DECIMAL_PLACES {
+		digits = strings.Repeat("0", DECIMAL_PLACES-len(digits)+1) + digits
+	}
+
+	whole, fraction := digits[:len(digits)-DECIMAL_PLACES], strings.TrimRight(digits[len(digits)-DECIMAL_PLACES:], "0")
+
+	if fraction == "" {
+		return sign + whole
+	}
+
+	return sign + whole + "." + fraction
+}
+
+// Decimals are encoded as JSON numbers with their exact digits
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Both JSON numbers and strings are accepted
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+
+	if s == "null" {
+		return nil
+	}
+
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := ParseDecimal(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = v
+	return nil
+}
+
+func abs(v int64) uint64 {
+	if v < 0 {
+		return uint64(-v)
+	}
+	return uint64(v)
+}
+
+func signed(v uint64, negative bool) (Decimal, error) {
+	if v > math.MaxInt64 {
+		return Zero, errors.New("Decimal overflow")
+	}
+	if negative {
+		return Decimal{-int64(v)}, nil
+	}
+	return Decimal{int64(v)}, nil
+}
+
+func must(d Decimal, err error) Decimal {
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
@@ -0,0 +1,80 @@
+package models
+
+// The number of price levels a side of the book shows by default
+const (
+	DEFAULT_DEPTH = 20
+)
+
+// The displayed liquidity at a single price, the resting orders
+// behind it are not disclosed. A level whose amount or value is out
+// of range is left without them
+type DepthLevel struct {
+	Price  Decimal `json:"price"`
+	Amount Decimal `json:"amount"`
+	Total  Decimal `json:"total"`
+	Count  int     `json:"count"`
+}
+
+// One side of the book aggregated by price level, best price first
+type Depth struct {
+	Items []*DepthLevel `json:"items"`
+}
+
+// Aggregate the displayed orders of a queue into at most limit price
+// levels, every level is shown when limit is not positive. Hidden
+// orders are left out and icebergs only count their displayed amount
+func Aggregate(q OrderQueue, limit int) *Depth {
+	depth := &Depth{Items: []*DepthLevel{}}
+
+	if q == nil {
+		return depth
+	}
+
+	var (
+		level    *DepthLevel
+		overflow bool
+	)
+
+	q.Range(func(o *Order) bool {
+		if o.Hidden {
+			return true
+		}
+
+		if level == nil || level.Price != o.Price {
+			if limit > 0 && len(depth.Items) == limit {
+				return false
+			}
+
+			level = &DepthLevel{Price: o.Price, Amount: Zero, Total: Zero}
+			depth.Items = append(depth.Items, level)
+			overflow = false
+		}
+
+		level.Count++
+
+		if overflow {
+			return true
+		}
+
+		amount, err := level.Amount.CheckedAdd(o.Amount)
+		total, errTotal := level.Price.CheckedMul(amount)
+
+		if overflow = err != nil || errTotal != nil; overflow {
+			level.Amount, level.Total = Zero, Zero
+			return true
+		}
+
+		level.Amount, level.Total = amount, total
+		return true
+	})
+
+	return depth
+}
+
+// The best level of the side, nil when it is empty
+func (d *Depth) Best() *DepthLevel {
+	if len(d.Items) == 0 {
+		return nil
+	}
+	return d.Items[0]
+}
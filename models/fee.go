@@ -0,0 +1,56 @@
+package models
+
+import "errors"
+
+// The fee rates of a tier, charged as a fraction of what each side of
+// a deal receives. A negative rate is a rebate paid to that side
+type FeeRate struct {
+	Maker Decimal `json:"maker"`
+	Taker Decimal `json:"taker"`
+}
+
+// A fee schedule prices the deals of a stock, accounts in a tier
+// pay the rates of the tier and every other account the default ones
+type FeeSchedule struct {
+	Default FeeRate            `json:"default"`
+	Tiers   map[string]FeeRate `json:"tiers"`
+}
+
+func NewFeeSchedule(maker, taker Decimal) *FeeSchedule {
+	return &FeeSchedule{
+		Default: FeeRate{maker, taker},
+		Tiers:   map[string]FeeRate{},
+	}
+}
+
+func (fs *FeeSchedule) SetTier(tier string, maker, taker Decimal) {
+	fs.Tiers[tier] = FeeRate{maker, taker}
+}
+
+// The rates of the tier, the default rates if the tier has none
+func (fs *FeeSchedule) Rate(tier string) FeeRate {
+	if rate, ok := fs.Tiers[tier]; ok {
+		return rate
+	}
+	return fs.Default
+}
+
+// Every rate must be a fraction of what a side receives, a rebate
+// included
+func (fs *FeeSchedule) Check() error {
+	rates := []FeeRate{fs.Default}
+
+	for _, rate := range fs.Tiers {
+		rates = append(rates, rate)
+	}
+
+	for _, rate := range rates {
+		for _, r := range []Decimal{rate.Maker, rate.Taker} {
+			if !r.LessThan(One) || !r.Neg().LessThan(One) {
+				return errors.New("Fee rate is out of range")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"container/list"
+)
+
+// A price level holds the resting orders at a single price, kept in
+// time priority so that the earliest order fills first. The orders
+// are linked and indexed by id so that any of them leaves at once
+type PriceLevel struct {
+	Price  Decimal `json:"price"`
+	orders *list.List
+	index  map[string]*list.Element
+}
+
+func NewLevel(price Decimal) *PriceLevel {
+	return &PriceLevel{
+		Price:  price,
+		orders: list.New(),
+		index:  map[string]*list.Element{},
+	}
+}
+
+// Insert an order behind every order that has time priority over it,
+// which is an append unless orders arrive out of sequence
+func (pl *PriceLevel) Insert(o *Order) {
+	e := pl.orders.Back()
+
+	for e != nil && o.Before(e.Value.(*Order)) {
+		e = e.Prev()
+	}
+
+	if e == nil {
+		pl.index[o.OrderId] = pl.orders.PushFront(o)
+	} else {
+		pl.index[o.OrderId] = pl.orders.InsertAfter(o, e)
+	}
+}
+
+func (pl *PriceLevel) Remove(id string) bool {
+	e, ok := pl.index[id]
+
+	if !ok {
+		return false
+	}
+
+	pl.orders.Remove(e)
+	delete(pl.index, id)
+	return true
+}
+
+func (pl *PriceLevel) Front() *Order {
+	if pl.IsEmpty() {
+		return nil
+	}
+	return pl.orders.Front().Value.(*Order)
+}
+
+// Visit the orders in time priority until fn returns false, whether
+// every order was visited
+func (pl *PriceLevel) Range(fn func(o *Order) bool) bool {
+	for e := pl.orders.Front(); e != nil; e = e.Next() {
+		if !fn(e.Value.(*Order)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pl *PriceLevel) Len() int {
+	return pl.orders.Len()
+}
+
+func (pl *PriceLevel) IsEmpty() bool {
+	return pl.Len() == 0
+}
@@ -8,6 +8,26 @@ const (
 	MESSAGE_COMMAND_SELL      = "SELL"
 	MESSAGE_COMMAND_ERROR     = "ERROR"
 	MESSAGE_COMMAND_SUMMARY   = "SUMMARY"
+	MESSAGE_COMMAND_EXPIRED   = "EXPIRED"
+	MESSAGE_COMMAND_CANCEL    = "CANCEL"
+	MESSAGE_COMMAND_CANCELLED = "CANCELLED"
+	MESSAGE_COMMAND_AMEND     = "AMEND"
+	MESSAGE_COMMAND_AMENDED   = "AMENDED"
+	// an order cancelled to prevent a self trade
+	MESSAGE_COMMAND_PREVENTED = "PREVENTED"
+	// an order reduced to prevent a self trade, it keeps trading
+	MESSAGE_COMMAND_DECREMENTED = "DECREMENTED"
+	// an order the book refused, e.g. a post-only order that would trade
+	MESSAGE_COMMAND_REJECTED = "REJECTED"
+	// a stop order released into the book by the last trade price
+	MESSAGE_COMMAND_TRIGGERED = "TRIGGERED"
+	// a stock entering a new trading phase
+	MESSAGE_COMMAND_PHASE = "PHASE"
+	// a stock halted or resuming after a halt
+	MESSAGE_COMMAND_HALT   = "HALT"
+	MESSAGE_COMMAND_RESUME = "RESUME"
+	// a stock removed from the exchange
+	MESSAGE_COMMAND_DELISTED = "DELISTED"
 )
 
 type Message struct {
@@ -16,6 +36,7 @@ type Message struct {
 	Stock     *Stock     `json:"stock"`
 	Summaries []*Summary `json:"summaries"`
 	Error     string     `json:"error"`
+	Phase     string     `json:"phase"`
 }
 
 func (msg *Message) GetCommand() string {
@@ -28,3 +49,28 @@ func NewErrorMessage(msg string) *Message {
 		Error:   msg,
 	}
 }
+
+// A notice about a single order, addressed to its owner
+func NewOrderMessage(command string, o *Order) *Message {
+	return &Message{
+		Command: command,
+		Order:   o,
+	}
+}
+
+// A notice to every client about the trading phase of a stock
+func NewPhaseMessage(s *Stock, phase string) *Message {
+	return &Message{
+		Command: MESSAGE_COMMAND_PHASE,
+		Stock:   s,
+		Phase:   phase,
+	}
+}
+
+// A notice to every client about a stock, e.g. a halt
+func NewStockMessage(command string, s *Stock) *Message {
+	return &Message{
+		Command: command,
+		Stock:   s,
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"github.com/satori/go.uuid"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,28 +11,321 @@ const (
 	ORDER_TYPE_BID = "BID"
 )
 
+const (
+	ORDER_KIND_LIMIT  = "LIMIT"
+	ORDER_KIND_MARKET = "MARKET"
+)
+
+const (
+	// good till cancelled, the order rests until filled or cancelled
+	TIME_IN_FORCE_GTC = "GTC"
+	// immediate or cancel, whatever does not fill on arrival is cancelled
+	TIME_IN_FORCE_IOC = "IOC"
+	// fill or kill, the order fills completely on arrival or not at all
+	TIME_IN_FORCE_FOK = "FOK"
+	// the order expires at the end of the trading day
+	TIME_IN_FORCE_DAY = "DAY"
+	// good till date, the order expires at ExpireTs
+	TIME_IN_FORCE_GTD = "GTD"
+)
+
+const (
+	// the incoming order is cancelled, the resting one is kept
+	SELF_TRADE_CANCEL_NEWEST = "CANCEL_NEWEST"
+	// the resting order is cancelled, the incoming one keeps trading
+	SELF_TRADE_CANCEL_OLDEST = "CANCEL_OLDEST"
+	// both orders are cancelled
+	SELF_TRADE_CANCEL_BOTH = "CANCEL_BOTH"
+	// both orders are reduced by the smaller amount, an order
+	// reduced to nothing is cancelled
+	SELF_TRADE_DECREMENT = "DECREMENT_CANCEL"
+)
+
+const (
+	// a post-only order that would trade on arrival is rejected
+	POST_ONLY_REJECT = "REJECT"
+	// a post-only order that would trade on arrival is repriced one
+	// tick behind the best opposite price
+	POST_ONLY_REPRICE = "REPRICE"
+)
+
+// Monotonic counter used to break ties between orders of the same timestamp
+var sequence uint64
+
 type Order struct {
 	OrderId   string  `json:"order_id"`
 	Market    string  `json:"market"`
 	Type      string  `json:"type"`
+	Kind      string  `json:"kind"`
 	StockCode string  `json:"stock_code"`
-	Price     float64 `json:"price"`
-	Amount    float64 `json:"amount"`
-	Total     float64 `json:"total"`
-	Timestamp int64   `json:"timestamp"`
-	Index     int     `json:"-"`
+	Price     Decimal `json:"price"`
+	Amount    Decimal `json:"amount"`
+	Total     Decimal `json:"total"`
+	// the furthest a market order may trade from the best price at
+	// arrival, as a fraction of that price, zero means unbounded
+	Slippage Decimal `json:"slippage"`
+	// a stop order waits in the trigger book until the last trade price
+	// reaches its stop price, it then trades as a limit or market order.
+	// A trailing stop moves its stop price after the market by a fixed
+	// amount or by a fraction of the last price
+	StopPrice    Decimal `json:"stop_price"`
+	TrailAmount  Decimal `json:"trail_amount"`
+	TrailPercent Decimal `json:"trail_percent"`
+	// an iceberg order rests showing at most its display amount, the
+	// hidden amount replenishes the displayed slice once it has traded
+	DisplayAmount Decimal `json:"display_amount"`
+	HiddenAmount  Decimal `json:"hidden_amount"`
+	TimeInForce   string  `json:"time_in_force"`
+	ExpireTs      int64   `json:"expire_ts"`
+	// the account placing the order, notices about it are addressed to
+	// the owner and Reserved is what the order still holds of its funds
+	Owner    string  `json:"owner"`
+	Reserved Decimal `json:"reserved"`
+	// a post-only order never takes liquidity, a hidden order matches
+	// as any other but is left out of the summaries of the book
+	PostOnly string `json:"post_only"`
+	Hidden   bool   `json:"hidden"`
+	// how an incoming order meeting a resting order of its own owner
+	// is handled, empty lets them trade
+	SelfTrade string `json:"self_trade"`
+	Timestamp int64  `json:"timestamp"`
+	Sequence  uint64 `json:"sequence"`
+}
+
+// An order whose value is out of range is left without a total, the
+// stock refuses it when it is placed
+func NewOrder(market, tp, code string, price, amount Decimal) *Order {
+	total, _ := price.CheckedMul(amount)
+
+	return &Order{
+		OrderId:     uuid.NewV4().String(),
+		Market:      market,
+		Type:        tp,
+		Kind:        ORDER_KIND_LIMIT,
+		StockCode:   code,
+		Price:       price,
+		Amount:      amount,
+		Total:       total,
+		TimeInForce: TIME_IN_FORCE_GTC,
+		Timestamp:   time.Now().Unix(),
+		Sequence:    atomic.AddUint64(&sequence, 1),
+	}
 }
 
-func NewOrder(market, tp, code string, price, amount float64) *Order {
+// A market order carries no price, it trades against the opposite
+// side of the book until filled and never rests in a queue
+func NewMarketOrder(market, tp, code string, amount, slippage Decimal) *Order {
 	return &Order{
-		OrderId:   uuid.NewV4().String(),
-		Market:    market,
-		Type:      tp,
-		StockCode: code,
-		Price:     price,
-		Amount:    amount,
-		Total:     price * amount,
-		Timestamp: time.Now().Unix(),
-		Index:     -1, // initialise index to -1 for safety
+		OrderId:     uuid.NewV4().String(),
+		Market:      market,
+		Type:        tp,
+		Kind:        ORDER_KIND_MARKET,
+		StockCode:   code,
+		Amount:      amount,
+		Slippage:    slippage,
+		TimeInForce: TIME_IN_FORCE_IOC,
+		Timestamp:   time.Now().Unix(),
+		Sequence:    atomic.AddUint64(&sequence, 1),
+	}
+}
+
+func (o *Order) IsMarket() bool {
+	return o.Kind == ORDER_KIND_MARKET
+}
+
+func (o *Order) IsStop() bool {
+	return o.StopPrice.IsPositive() || o.IsTrailing()
+}
+
+func (o *Order) IsTrailing() bool {
+	return o.TrailAmount.IsPositive() || o.TrailPercent.IsPositive()
+}
+
+// Whether the last trade price triggers the stop order, a buy stop
+// triggers at or above its stop price and a sell stop at or below
+func (o *Order) Triggers(last Decimal) bool {
+	if !o.StopPrice.IsPositive() || !last.IsPositive() {
+		return false
+	}
+	if o.Type == ORDER_TYPE_BID {
+		return !last.LessThan(o.StopPrice)
+	}
+	return !last.GreaterThan(o.StopPrice)
+}
+
+// Move the stop price of a trailing stop after the last trade price,
+// it only ever moves towards the market
+func (o *Order) Trail(last Decimal) {
+	if !o.IsTrailing() || !last.IsPositive() {
+		return
+	}
+
+	offset := o.TrailAmount
+
+	if o.TrailPercent.IsPositive() {
+		offset = last.Mul(o.TrailPercent)
+	}
+
+	if o.Type == ORDER_TYPE_BID {
+		if stop := last.Add(offset); o.StopPrice.IsZero() || stop.LessThan(o.StopPrice) {
+			o.StopPrice = stop
+		}
+	} else if stop := last.Sub(offset); o.StopPrice.IsZero() || stop.GreaterThan(o.StopPrice) {
+		o.StopPrice = stop
+	}
+}
+
+func (o *Order) IsIceberg() bool {
+	return o.DisplayAmount.IsPositive()
+}
+
+// The amount the order still has to trade, displayed or not
+func (o *Order) Remaining() Decimal {
+	return o.Amount.Add(o.HiddenAmount)
+}
+
+// Hide whatever an iceberg order holds beyond its display amount
+// before it rests
+func (o *Order) Conceal() {
+	if !o.IsIceberg() || !o.Amount.GreaterThan(o.DisplayAmount) {
+		return
+	}
+
+	o.HiddenAmount = o.HiddenAmount.Add(o.Amount.Sub(o.DisplayAmount))
+	o.Amount = o.DisplayAmount
+	o.Total = o.Price.Mul(o.Amount)
+}
+
+// Display a fresh slice of an iceberg order from its hidden amount,
+// the slice goes behind the orders already resting at its price. It
+// reports whether anything was left to display
+func (o *Order) Replenish() bool {
+	if !o.HiddenAmount.IsPositive() {
+		return false
+	}
+
+	o.Amount = MinDecimal(o.DisplayAmount, o.HiddenAmount)
+	o.HiddenAmount = o.HiddenAmount.Sub(o.Amount)
+	o.Total = o.Price.Mul(o.Amount)
+	o.Restamp()
+	return true
+}
+
+// Rescale the order for a split giving to new shares for every from
+// shares. Prices are rounded to the tick in favour of the funds held,
+// down for a bid and up for an ask, and amounts down to the lot. An
+// ask holds the shares it has left. It reports whether anything is
+// left of the order
+func (o *Order) Split(from, to int64, tick, lot Decimal) bool {
+	price, _ := o.Price.Scale(from, to)
+	price = price.Truncate(tick)
+
+	// the rounded price is below the exact one unless it went back
+	// to the original price
+	if o.Type == ORDER_TYPE_ASK && price.Mul(NewDecimalFromInt(to)).LessThan(o.Price.Mul(NewDecimalFromInt(from))) {
+		price = price.Add(tick)
+	}
+
+	var (
+		stop, _    = o.StopPrice.Scale(from, to)
+		trail, _   = o.TrailAmount.Scale(from, to)
+		amount, _  = o.Amount.Scale(to, from)
+		hidden, _  = o.HiddenAmount.Scale(to, from)
+		display, _ = o.DisplayAmount.Scale(to, from)
+	)
+
+	o.Price = price
+	o.StopPrice = stop.Truncate(tick)
+	o.TrailAmount = trail
+	o.Amount = amount.Truncate(lot)
+	o.HiddenAmount = hidden.Truncate(lot)
+	o.Total = o.Price.Mul(o.Amount)
+
+	// an iceberg keeps displaying at least a lot
+	if o.IsIceberg() {
+		o.DisplayAmount = MaxDecimal(display.Truncate(lot), lot)
+	}
+
+	if o.Amount.IsZero() {
+		o.Replenish()
+	}
+
+	if o.Type == ORDER_TYPE_ASK && o.Reserved.IsPositive() {
+		o.Reserved = o.Remaining()
+	}
+
+	return o.Remaining().IsPositive()
+}
+
+// Whether the order can be rescaled for a split without leaving the
+// range of a decimal
+func (o *Order) Splits(from, to int64, tick Decimal) bool {
+	var (
+		price, overPrice   = o.Price.Scale(from, to)
+		amount, overAmount = o.Remaining().Scale(to, from)
+		_, overTotal       = price.Add(tick).CheckedMul(amount)
+		_, overExact       = o.Price.CheckedMul(NewDecimalFromInt(from))
+		_, overRounded     = price.Add(tick).CheckedMul(NewDecimalFromInt(to))
+		_, overDisplay     = o.DisplayAmount.Scale(to, from)
+		_, overStop        = o.StopPrice.Scale(from, to)
+		_, overTrail       = o.TrailAmount.Scale(from, to)
+	)
+
+	for _, err := range []error{overPrice, overAmount, overTotal, overExact, overRounded, overDisplay, overStop, overTrail} {
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether whatever remains of the order after trading on arrival
+// may rest in the book
+func (o *Order) IsResting() bool {
+	if o.IsMarket() {
+		return false
+	}
+	return o.TimeInForce != TIME_IN_FORCE_IOC && o.TimeInForce != TIME_IN_FORCE_FOK
+}
+
+// Whether the order expires by itself while resting
+func (o *Order) Expires() bool {
+	return o.TimeInForce == TIME_IN_FORCE_DAY || o.TimeInForce == TIME_IN_FORCE_GTD
+}
+
+// Whether the order is willing to trade at the given price,
+// a market order accepts any price
+func (o *Order) Accepts(price Decimal) bool {
+	if o.IsMarket() {
+		return true
+	}
+	if o.Type == ORDER_TYPE_ASK {
+		return !price.LessThan(o.Price)
+	}
+	return !price.GreaterThan(o.Price)
+}
+
+// Give the order a fresh place in time priority, e.g. after an
+// amendment that loses its priority
+func (o *Order) Restamp() {
+	o.Timestamp = time.Now().Unix()
+	o.Sequence = atomic.AddUint64(&sequence, 1)
+}
+
+// The asset an order spends, cash of its market for a bid and shares
+// of its stock for an ask
+func (o *Order) Asset() string {
+	if o.Type == ORDER_TYPE_BID {
+		return o.Market
+	}
+	return o.StockCode
+}
+
+// Whether the order has time priority over another one
+func (o *Order) Before(other *Order) bool {
+	if o.Timestamp != other.Timestamp {
+		return o.Timestamp < other.Timestamp
 	}
+	return o.Sequence < other.Sequence
 }
@@ -3,63 +3,266 @@ package models
 // Acknowledgement: https://github.com/jupp0r/go-priority-queue/blob/master/priorty_queue.go
 
 import (
-	"container/heap"
 	"errors"
 	// "fmt"
 	"github.com/gravel/math"
+	"sort"
 	"sync"
 )
 
 // Important: unlike the operations under OrderQueue,
 // OrderBook struct is thread unsafe, please use Exchange
-// to handle higher-level concurrencies
-func NewBook() *OrderBook {
+// to handle higher-level concurrencies. Each book is owned
+// by a single broker which is the only writer of its queues
+func NewBook(code string) *OrderBook {
 	return &OrderBook{
-		queues: map[string]OrderQueue{},
-		Deals:  make(chan *Deal),
+		Code:      code,
+		queues:    map[string]OrderQueue{},
+		triggers:  map[string]*TriggerBook{},
+		markets:   []string{},
+		histories: map[string][]*Deal{},
+		pricing:   MakerPricing,
+		fees:      NewFeeSchedule(Zero, Zero),
+		depth:     DEFAULT_DEPTH,
+		Deals:     make(chan *Deal),
 	}
 }
 
-// An orderbook lists the trading options for a specified stock
+// An orderbook lists the trading options for a specified stock,
+// the stock may trade in several markets each quoted in its own
+// currency with a pair of queues, a trigger book of stop orders
+// and a deal history
 type OrderBook struct {
+	Code      string
 	queues    map[string]OrderQueue
-	histories []*Deal
+	triggers  map[string]*TriggerBook
+	markets   []string
+	histories map[string][]*Deal
+	pricing   PricingRule
+	fees      *FeeSchedule
+	bands     *PriceBands
+	breaker   *CircuitBreaker
+	auction   bool
+	halted    bool
+	suspended bool
+	depth     int
 	Deals     chan *Deal
 	sync.Mutex
 }
 
-func (ob *OrderBook) Sum() *Summary {
-	length := len(ob.histories)
+// The queues of a market are keyed by the market and the order side,
+// e.g. BTC_ASK, BTC_BID, ETH_ASK, ETH_BID
+func QueueKey(market, side string) string {
+	return market + "_" + side
+}
 
-	if length == 0 {
-		return &Summary{
-			Queues:    ob.queues,
-			Histories: []*Deal{},
+// Open a market with its own pair of queues
+func (ob *OrderBook) AddMarket(market string) {
+	ob.Lock()
+	defer ob.Unlock()
+
+	if _, ok := ob.queues[QueueKey(market, ORDER_TYPE_ASK)]; ok {
+		return
+	}
+
+	ob.queues[QueueKey(market, ORDER_TYPE_ASK)] = NewQueueAsk()
+	ob.queues[QueueKey(market, ORDER_TYPE_BID)] = NewQueueBid()
+	ob.triggers[market] = NewTriggerBook()
+	ob.markets = append(ob.markets, market)
+}
+
+func (ob *OrderBook) Markets() []string {
+	ob.Lock()
+	defer ob.Unlock()
+	return append([]string{}, ob.markets...)
+}
+
+// The stop orders of a market
+func (ob *OrderBook) Triggers(market string) *TriggerBook {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.triggers[market]
+}
+
+// Summarise a market, its depth aggregates the orders that are not
+// hidden by price level for each order side. While the book is in a
+// call auction or halted the summary carries the indicative uncrossing
+func (ob *OrderBook) Sum(market string) *Summary {
+	ob.Lock()
+	defer ob.Unlock()
+
+	var (
+		histories = ob.histories[market]
+		length    = len(histories)
+		asks      = ob.queues[QueueKey(market, ORDER_TYPE_ASK)]
+		bids      = ob.queues[QueueKey(market, ORDER_TYPE_BID)]
+		summary   = &Summary{
+			StockCode: ob.Code,
+			Market:    market,
+			Halted:    ob.halted || ob.suspended,
+			Depth: map[string]*Depth{
+				ORDER_TYPE_ASK: Aggregate(asks, ob.depth),
+				ORDER_TYPE_BID: Aggregate(bids, ob.depth),
+			},
 		}
+	)
+
+	if triggers := ob.triggers[market]; (ob.auction || ob.halted || ob.suspended) && triggers != nil {
+		summary.Auction = Equilibrium(asks, bids, triggers.Last())
 	}
 
-	return &Summary{
-		Queues:    ob.queues,
-		Histories: ob.histories[math.MaxInt(length-100, 0):],
+	if length == 0 {
+		summary.Histories = []*Deal{}
+	} else {
+		summary.Histories = histories[math.MaxInt(length-100, 0):]
 	}
+
+	return summary
 }
 
-func (ob *OrderBook) Update() {
-	select {
-	case deal := <-ob.Deals:
-		// fmt.Println("Price:", deal.Price, "Amount:", deal.Amount, "Timestamp:", deal.Timestamp, "Total:", deal.Total)
-		ob.Lock()
-		ob.histories = append(ob.histories, deal)
-		ob.Unlock()
-	default:
+// Every deal of the book keyed by market
+func (ob *OrderBook) Histories() map[string][]*Deal {
+	ob.Lock()
+	defer ob.Unlock()
+
+	histories := map[string][]*Deal{}
+
+	for market, deals := range ob.histories {
+		histories[market] = append([]*Deal{}, deals...)
 	}
+
+	return histories
+}
+
+// Record the deals of the book until done is closed
+func (ob *OrderBook) Listen(done <-chan struct{}) {
+	for {
+		select {
+		case deal := <-ob.Deals:
+			// fmt.Println("Price:", deal.Price, "Amount:", deal.Amount, "Timestamp:", deal.Timestamp, "Total:", deal.Total)
+			ob.Lock()
+			ob.histories[deal.Market] = append(ob.histories[deal.Market], deal)
+			ob.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Choose how crossing orders are priced, books trade at the maker's
+// price unless configured otherwise
+func (ob *OrderBook) SetPricing(rule PricingRule) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.pricing = rule
+}
+
+func (ob *OrderBook) Pricing() PricingRule {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.pricing
+}
+
+// Choose the fees charged on the deals of the book, books charge
+// no fees unless configured otherwise
+func (ob *OrderBook) SetFees(fees *FeeSchedule) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.fees = fees
+}
+
+func (ob *OrderBook) Fees() *FeeSchedule {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.fees
+}
+
+// In a call auction orders accumulate without matching until the
+// book is uncrossed
+func (ob *OrderBook) SetAuction(auction bool) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.auction = auction
+}
+
+func (ob *OrderBook) InAuction() bool {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.auction
+}
+
+// Keep the trades of the book within price bands, books trade at
+// any price unless configured otherwise
+func (ob *OrderBook) SetBands(bands *PriceBands) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.bands = bands
+}
+
+func (ob *OrderBook) Bands() *PriceBands {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.bands
+}
+
+// Halt the book on large price moves, books are never halted by
+// themselves unless configured otherwise
+func (ob *OrderBook) SetBreaker(breaker *CircuitBreaker) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.breaker = breaker
+}
+
+func (ob *OrderBook) Breaker() *CircuitBreaker {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.breaker
+}
+
+// A halted book queues its orders without matching until resumed
+func (ob *OrderBook) SetHalted(halted bool) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.halted = halted
+}
+
+func (ob *OrderBook) IsHalted() bool {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.halted
+}
+
+// A suspended book was halted by an operator, it queues its orders
+// until reinstated whatever its circuit breaker or phase
+func (ob *OrderBook) SetSuspended(suspended bool) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.suspended = suspended
+}
+
+func (ob *OrderBook) IsSuspended() bool {
+	ob.Lock()
+	defer ob.Unlock()
+	return ob.suspended
+}
+
+// Limit the price levels each side of the summary shows, every
+// level is shown when levels is not positive
+func (ob *OrderBook) SetDepth(levels int) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.depth = levels
 }
 
 func (ob *OrderBook) SetQueue(key string, queue OrderQueue) {
+	ob.Lock()
+	defer ob.Unlock()
 	ob.queues[key] = queue
 }
 
 func (ob *OrderBook) GetQueue(key string) OrderQueue {
+	ob.Lock()
+	defer ob.Unlock()
 	return ob.queues[key]
 }
 
@@ -67,236 +270,272 @@ func (ob *OrderBook) Queues() *map[string]OrderQueue {
 	return &ob.queues
 }
 
+// Clients are sent the aggregated depth in place of the queues,
+// under the key the queues used to be serialised with
 type Summary struct {
-	Queues    map[string]OrderQueue `json:"queues"`
-	Histories []*Deal               `json:"histories"`
+	StockCode string            `json:"stock_code"`
+	Market    string            `json:"market"`
+	Depth     map[string]*Depth `json:"queues"`
+	Histories []*Deal           `json:"histories"`
+	Auction   *Auction          `json:"auction,omitempty"`
+	Phase     string            `json:"phase"`
+	Halted    bool              `json:"halted"`
 }
 
 type OrderQueue interface {
 	Init()
 	Add(o *Order)
 	Update(id string, n *Order) error
+	Remove(id string) *Order
+	Find(id string) *Order
 	Peek(i int) *Order
+	Range(fn func(o *Order) bool)
 	Len() int
 	Next() *Order
 	IsEmpty() bool
 }
 
 func NewQueueAsk() *OrderQueueAsk {
-	return &OrderQueueAsk{
-		Items:  []*Order{},
-		lookup: map[interface{}]*Order{},
-	}
+	ask := &OrderQueueAsk{}
+	ask.init(func(a, b Decimal) bool {
+		return a.LessThan(b)
+	})
+	return ask
 }
 
+// Asks are served lowest price first, then by time priority
 type OrderQueueAsk struct {
-	Items  []*Order               `json:"items"`
-	lookup map[interface{}]*Order // two-way mappings
-	sync.RWMutex
+	orderQueue
 }
 
-// Interface method for heap
-func (ask *OrderQueueAsk) Len() int {
-	return len(ask.Items)
-}
-
-// Interface method for heap
-func (ask *OrderQueueAsk) Less(i, j int) bool {
-	return ask.Items[i].Price < ask.Items[j].Price
+func NewQueueBid() *OrderQueueBid {
+	bid := &OrderQueueBid{}
+	bid.init(func(a, b Decimal) bool {
+		return a.GreaterThan(b)
+	})
+	return bid
 }
 
-// Interface method for heap
-func (ask *OrderQueueAsk) Swap(i, j int) {
-	ask.Items[i], ask.Items[j] = ask.Items[j], ask.Items[i]
-	ask.Items[i].Index = i
-	ask.Items[j].Index = j
+// Bids are served highest price first, then by time priority
+type OrderQueueBid struct {
+	orderQueue
+}
+
+// The shared implementation behind OrderQueueAsk and OrderQueueBid:
+// price levels are kept sorted from the worst price to the best, so
+// that the best level is last and leaves without a shift, while each
+// level is a FIFO list
+type orderQueue struct {
+	levels []*PriceLevel
+	better func(a, b Decimal) bool
+	prices map[Decimal]*PriceLevel
+	lookup map[string]*Order
+	size   int
+	sync.RWMutex
 }
 
-// Interface method for heap
-func (ask *OrderQueueAsk) Push(x interface{}) {
-	order := x.(*Order)
-	order.Index = ask.Len()
-	ask.Items = append(ask.Items, order)
+func (q *orderQueue) init(better func(a, b Decimal) bool) {
+	q.levels = []*PriceLevel{}
+	q.better = better
+	q.prices = map[Decimal]*PriceLevel{}
+	q.lookup = map[string]*Order{}
 }
 
-// Interface method for heap
-func (ask *OrderQueueAsk) Pop() interface{} {
-	n := ask.Len()
-	order := ask.Items[n-1]
-	order.Index = -1
-	ask.Items = ask.Items[0 : n-1]
-	return order
-}
+// Initialise the order queue, the levels are sorted as orders come
+// and go so this only restores their order
+func (q *orderQueue) Init() {
+	q.Lock()
+	defer q.Unlock()
 
-// Initialise the order queue
-func (ask *OrderQueueAsk) Init() {
-	ask.Lock()
-	defer ask.Unlock()
-	heap.Init(ask)
+	sort.Slice(q.levels, func(i, j int) bool {
+		return q.better(q.levels[j].Price, q.levels[i].Price)
+	})
 }
 
 // Add a new order in the orderbook
-func (ask *OrderQueueAsk) Add(o *Order) {
-	ask.Lock()
-	defer ask.Unlock()
+func (q *orderQueue) Add(o *Order) {
+	q.Lock()
+	defer q.Unlock()
 
-	if _, ok := ask.lookup[o.OrderId]; ok {
+	if _, ok := q.lookup[o.OrderId]; ok {
 		return
 	}
 
-	heap.Push(ask, o)
-	ask.lookup[o.OrderId] = o
+	q.insert(o)
 }
 
-func (ask *OrderQueueAsk) Next() *Order {
-	if ask.IsEmpty() {
+func (q *orderQueue) Next() *Order {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.size == 0 {
 		return nil
 	}
 
-	ask.Lock()
-	defer ask.Unlock()
-
-	order := heap.Pop(ask).(*Order)
-	delete(ask.lookup, order.OrderId)
+	order := q.best().Front()
+	q.remove(order)
 	return order
 }
 
-func (ask *OrderQueueAsk) Update(id string, n *Order) error {
-	if _, ok := ask.lookup[id]; !ok {
+// Amend the price and amount of a resting order in place, its identity
+// is kept. The order keeps its time priority when only its amount is
+// reduced, otherwise it moves behind the orders at its new price
+func (q *orderQueue) Update(id string, n *Order) error {
+	q.Lock()
+	defer q.Unlock()
+
+	order, ok := q.lookup[id]
+
+	if !ok {
 		return errors.New("Order does not exist")
 	}
 
-	ask.Lock()
-	defer ask.Unlock()
-
-	index := ask.lookup[id].Index
+	if n.Price == order.Price && !n.Amount.GreaterThan(order.Amount) {
+		order.Amount = n.Amount
+		order.Total = order.Price.Mul(order.Amount)
+		return nil
+	}
 
-	*(ask.lookup[id]) = *n
-	heap.Fix(ask, index)
+	q.remove(order)
+	order.Price = n.Price
+	order.Amount = n.Amount
+	order.Total = order.Price.Mul(order.Amount)
+	order.Restamp()
+	q.insert(order)
 	return nil
 }
 
-// debug: concurrent access
-func (ask *OrderQueueAsk) Peek(i int) *Order {
+// Remove an order wherever it rests, nil if it is not in the queue
+func (q *orderQueue) Remove(id string) *Order {
+	q.Lock()
+	defer q.Unlock()
 
-	var (
-		l = ask.Len()
-	)
+	order, ok := q.lookup[id]
 
-	if i >= l {
+	if !ok {
 		return nil
 	}
 
-	return ask.Items[i]
+	q.remove(order)
+	return order
 }
 
-func (ask *OrderQueueAsk) IsEmpty() bool {
-	return ask.Len() == 0
+// Look up a resting order, nil if it is not in the queue
+func (q *orderQueue) Find(id string) *Order {
+	q.RLock()
+	defer q.RUnlock()
+	return q.lookup[id]
 }
 
-func NewQueueBid() *OrderQueueBid {
-	return &OrderQueueBid{
-		Items:  []*Order{},
-		lookup: map[interface{}]*Order{},
+// Peek the i-th order in price-time priority
+func (q *orderQueue) Peek(i int) *Order {
+	q.RLock()
+	defer q.RUnlock()
+
+	if i < 0 || i >= q.size {
+		return nil
 	}
-}
 
-type OrderQueueBid struct {
-	Items  []*Order               `json:"items"`
-	lookup map[interface{}]*Order // two-way mappings
-	sync.RWMutex
-}
+	for j := len(q.levels) - 1; j >= 0; j-- {
+		level := q.levels[j]
 
-// Interface method for heap
-func (bid *OrderQueueBid) Len() int {
-	return len(bid.Items)
-}
+		if i >= level.Len() {
+			i -= level.Len()
+			continue
+		}
 
-// Interface method for heap
-func (bid *OrderQueueBid) Less(i, j int) bool {
-	return bid.Items[i].Price > bid.Items[j].Price
-}
+		var found *Order
 
-// Interface method for heap
-func (bid *OrderQueueBid) Swap(i, j int) {
-	bid.Items[i], bid.Items[j] = bid.Items[j], bid.Items[i]
-	bid.Items[i].Index = i
-	bid.Items[j].Index = j
-}
+		level.Range(func(o *Order) bool {
+			if i == 0 {
+				found = o
+				return false
+			}
+			i--
+			return true
+		})
 
-// Interface method for heap
-func (bid *OrderQueueBid) Push(x interface{}) {
-	order := x.(*Order)
-	order.Index = bid.Len()
-	bid.Items = append(bid.Items, order)
-}
+		return found
+	}
 
-// Interface method for heap
-func (bid *OrderQueueBid) Pop() interface{} {
-	n := bid.Len()
-	order := bid.Items[n-1]
-	order.Index = -1
-	bid.Items = bid.Items[0 : n-1]
-	return order
+	return nil
 }
 
-// Initialise the order queue
-func (bid *OrderQueueBid) Init() {
-	bid.Lock()
-	defer bid.Unlock()
-	heap.Init(bid)
+// Visit the orders in price-time priority until fn returns false,
+// fn must not modify the queue
+func (q *orderQueue) Range(fn func(o *Order) bool) {
+	q.RLock()
+	defer q.RUnlock()
+	q.each(fn)
 }
 
-// Add a new order in the orderbook
-func (bid *OrderQueueBid) Add(o *Order) {
-	bid.Lock()
-	defer bid.Unlock()
+func (q *orderQueue) Len() int {
+	q.RLock()
+	defer q.RUnlock()
+	return q.size
+}
 
-	if _, ok := bid.lookup[o.OrderId]; ok {
-		return
-	}
+func (q *orderQueue) IsEmpty() bool {
+	return q.Len() == 0
+}
 
-	heap.Push(bid, o)
-	bid.lookup[o.OrderId] = o
+// The best price level, the caller must hold the lock and make sure
+// the queue is not empty
+func (q *orderQueue) best() *PriceLevel {
+	return q.levels[len(q.levels)-1]
 }
 
-func (bid *OrderQueueBid) Next() *Order {
-	if bid.IsEmpty() {
-		return nil
+// Visit the orders from the best level to the worst until fn returns
+// false, the caller must hold the lock
+func (q *orderQueue) each(fn func(o *Order) bool) {
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		if !q.levels[i].Range(fn) {
+			return
+		}
 	}
+}
 
-	bid.Lock()
-	defer bid.Unlock()
-
-	order := heap.Pop(bid).(*Order)
-	delete(bid.lookup, order.OrderId)
-	return order
+// The position of the level at the price, or where it belongs. The
+// caller must hold the lock
+func (q *orderQueue) search(price Decimal) int {
+	return sort.Search(len(q.levels), func(i int) bool {
+		return !q.better(price, q.levels[i].Price)
+	})
 }
 
-func (bid *OrderQueueBid) Update(id string, n *Order) error {
-	if _, ok := bid.lookup[id]; !ok {
-		return errors.New("Order does not exist")
-	}
+// The caller must hold the lock
+func (q *orderQueue) insert(o *Order) {
+	level, ok := q.prices[o.Price]
 
-	bid.RLock()
-	defer bid.RUnlock()
+	if !ok {
+		level = NewLevel(o.Price)
+		q.prices[o.Price] = level
 
-	index := bid.lookup[id].Index
+		i := q.search(o.Price)
+		q.levels = append(q.levels, nil)
+		copy(q.levels[i+1:], q.levels[i:])
+		q.levels[i] = level
+	}
 
-	*(bid.lookup[id]) = *n
-	heap.Fix(bid, index)
-	return nil
+	level.Insert(o)
+	q.lookup[o.OrderId] = o
+	q.size++
 }
 
-func (bid *OrderQueueBid) Peek(i int) *Order {
+// The caller must hold the lock
+func (q *orderQueue) remove(o *Order) {
+	level := q.prices[o.Price]
 
-	if i >= bid.Len() {
-		return nil
+	if level == nil || !level.Remove(o.OrderId) {
+		return
 	}
 
-	return bid.Items[i]
-}
+	if level.IsEmpty() {
+		i := q.search(level.Price)
+		q.levels = append(q.levels[:i], q.levels[i+1:]...)
+		delete(q.prices, level.Price)
+	}
 
-func (bid *OrderQueueBid) IsEmpty() bool {
-	return bid.Len() == 0
+	delete(q.lookup, o.OrderId)
+	q.size--
 }
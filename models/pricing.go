@@ -0,0 +1,30 @@
+package models
+
+// A pricing rule decides the price at which a resting (maker)
+// order and an incoming (taker) order crossing it trade, the
+// price must be a multiple of the price step of the stock
+type PricingRule func(maker, taker *Order, step Decimal) Decimal
+
+// Continuous markets trade at the price of the resting order
+func MakerPricing(maker, taker *Order, step Decimal) Decimal {
+	return maker.Price
+}
+
+// Special markets may split the difference between both limits,
+// a market order has no limit so it trades at the maker's price.
+// A midpoint off the grid is moved one half step towards the maker
+func MidpointPricing(maker, taker *Order, step Decimal) Decimal {
+	if taker.IsMarket() {
+		return maker.Price
+	}
+
+	var (
+		midpoint = maker.Price.Add(taker.Price).Div(NewDecimalFromInt(2))
+		price    = midpoint.Truncate(step)
+	)
+
+	if price != midpoint && maker.Price.GreaterThan(midpoint) {
+		price = price.Add(step)
+	}
+	return price
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// orders are queued for the opening auction
+	PHASE_PRE_OPEN = "PRE_OPEN"
+	// the opening auction is called, orders are still queued
+	PHASE_OPENING_AUCTION = "OPENING_AUCTION"
+	// orders match as they arrive
+	PHASE_CONTINUOUS = "CONTINUOUS"
+	// orders are queued for the closing auction
+	PHASE_CLOSING_AUCTION = "CLOSING_AUCTION"
+	// orders are rejected
+	PHASE_CLOSED = "CLOSED"
+)
+
+// A clock tells the time sessions are scheduled against, tests and
+// simulations may replace the wall clock
+type Clock func() time.Time
+
+// Whether orders are queued for an auction during the phase
+func IsAuctionPhase(phase string) bool {
+	return phase == PHASE_PRE_OPEN || phase == PHASE_OPENING_AUCTION || phase == PHASE_CLOSING_AUCTION
+}
+
+// A session starts a phase at a time of the day, given as the time
+// since midnight
+type Session struct {
+	Phase string        `json:"phase"`
+	Start time.Duration `json:"start"`
+}
+
+// A schedule is the trading calendar of a stock. On a trading day the
+// phase is the one of the last session started, before the first one
+// and on any other day the market is closed
+type Schedule struct {
+	Sessions []Session       `json:"sessions"`
+	Days     []time.Weekday  `json:"days"`
+	Holidays map[string]bool `json:"holidays"`
+	Location *time.Location  `json:"-"`
+}
+
+// A schedule trading the sessions from Monday to Friday in UTC
+func NewSchedule(sessions ...Session) *Schedule {
+	sorted := append([]Session{}, sessions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	return &Schedule{
+		Sessions: sorted,
+		Days:     []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Holidays: map[string]bool{},
+		Location: time.UTC,
+	}
+}
+
+// Close the market for the whole day of the date
+func (s *Schedule) AddHoliday(date time.Time) {
+	s.Holidays[date.In(s.Location).Format("2006-01-02")] = true
+}
+
+// The phase of the market at a time
+func (s *Schedule) Phase(t time.Time) string {
+	t = t.In(s.Location)
+
+	if !s.trades(t) {
+		return PHASE_CLOSED
+	}
+
+	var (
+		midnight = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.Location)
+		offset   = t.Sub(midnight)
+		phase    = PHASE_CLOSED
+	)
+
+	for _, session := range s.Sessions {
+		if offset < session.Start {
+			break
+		}
+		phase = session.Phase
+	}
+
+	return phase
+}
+
+// When the trading day of the time ends, at the first session closing
+// the market after the time or else at the next midnight, both in the
+// location of the schedule
+func (s *Schedule) Close(t time.Time) time.Time {
+	t = t.In(s.Location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.Location)
+
+	for _, session := range s.Sessions {
+		if end := midnight.Add(session.Start); session.Phase == PHASE_CLOSED && end.After(t) {
+			return end
+		}
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.Location)
+}
+
+// Whether the market opens on the day of the time at all
+func (s *Schedule) trades(t time.Time) bool {
+	if s.Holidays[t.Format("2006-01-02")] {
+		return false
+	}
+
+	for _, day := range s.Days {
+		if day == t.Weekday() {
+			return true
+		}
+	}
+
+	return false
+}
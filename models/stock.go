@@ -1,20 +1,42 @@
 package models
 
 import (
+	"errors"
+	"math"
+	"strconv"
 	"time"
 )
 
+const (
+	DEFAULT_MARKET = "USD"
+	// the largest price and amount of an order, beyond them the
+	// arithmetic of the book may leave the range of a decimal
+	MAX_PRICE  = 1000000000
+	MAX_AMOUNT = 1000000000
+)
+
 type Stock struct {
 	Name              string  `json:"name"`
 	Code              string  `json:"code"`
 	Description       string  `json:"description"`
 	IssueTs           int64   `json:"issue_ts"`
-	TotalSupply       float64 `json:"total_supploy"`
-	CirculatingSupply float64 `json:"circulating_supply"`
+	TotalSupply       Decimal `json:"total_supply"`
+	CirculatingSupply Decimal `json:"circulating_supply"`
 	Reference         string  `json:"reference"`
+	// quote currencies the stock trades in, each is a separate market
+	Markets []string `json:"markets"`
+	// decimal places accepted for prices and amounts of orders
+	PricePrecision  int `json:"price_precision"`
+	AmountPrecision int `json:"amount_precision"`
+	// trading rules, a zero value leaves the rule unenforced
+	TickSize    Decimal `json:"tick_size"`
+	LotSize     Decimal `json:"lot_size"`
+	MinAmount   Decimal `json:"min_amount"`
+	MaxAmount   Decimal `json:"max_amount"`
+	MinNotional Decimal `json:"min_notional"`
 }
 
-func NewStock(name, code, desc string, total, circul float64, ref string) *Stock {
+func NewStock(name, code, desc string, total, circul Decimal, ref string) *Stock {
 	return &Stock{
 		Name:              name,
 		Code:              code,
@@ -23,5 +45,115 @@ func NewStock(name, code, desc string, total, circul float64, ref string) *Stock
 		TotalSupply:       total,
 		CirculatingSupply: circul,
 		Reference:         ref,
+		Markets:           []string{DEFAULT_MARKET},
+		PricePrecision:    DECIMAL_PLACES,
+		AmountPrecision:   DECIMAL_PLACES,
+	}
+}
+
+// The smallest amount a price may change by
+func (s *Stock) PriceStep() Decimal {
+	if s.TickSize.IsPositive() {
+		return s.TickSize
+	}
+	return One.Div(NewDecimalFromInt(int64(math.Pow10(s.PricePrecision))))
+}
+
+// The smallest amount an order may change by
+func (s *Stock) AmountStep() Decimal {
+	if s.LotSize.IsPositive() {
+		return s.LotSize
+	}
+	return One.Div(NewDecimalFromInt(int64(math.Pow10(s.AmountPrecision))))
+}
+
+// Rescale the total supply and the amount limits for a split giving to
+// new shares for every from shares, rounded to the amount step in
+// favour of the limits. The tick and lot sizes are a grid rather than
+// a number of shares and the min notional is a value, they are kept
+func (s *Stock) Split(from, to int64) error {
+	var (
+		step            = s.AmountStep()
+		total, overflow = s.TotalSupply.Scale(to, from)
+		min, _          = s.MinAmount.Scale(to, from)
+		max, _          = s.MaxAmount.Scale(to, from)
+	)
+
+	if overflow != nil {
+		return errors.New("Split is out of range for the supply")
 	}
+
+	s.TotalSupply = total.Truncate(step)
+	s.MaxAmount = max.Truncate(step)
+
+	if s.MinAmount = min.Truncate(step); s.MinAmount.LessThan(min) {
+		s.MinAmount = s.MinAmount.Add(step)
+	}
+
+	return nil
+}
+
+// Check that an order is acceptable for trading the stock, the error
+// explains which rule the order violates
+func (s *Stock) Check(o *Order) error {
+	if !o.Amount.IsPositive() {
+		return errors.New("Amount must be positive")
+	}
+
+	if !o.IsMarket() && !o.Price.IsPositive() {
+		return errors.New("Price must be positive")
+	}
+
+	if o.Price.GreaterThan(NewDecimalFromInt(MAX_PRICE)) || o.StopPrice.GreaterThan(NewDecimalFromInt(MAX_PRICE)) || o.TrailAmount.GreaterThan(NewDecimalFromInt(MAX_PRICE)) {
+		return errors.New("Price is out of range")
+	}
+
+	if o.Amount.GreaterThan(NewDecimalFromInt(MAX_AMOUNT)) {
+		return errors.New("Amount is out of range")
+	}
+
+	if o.Price.Places() > s.PricePrecision {
+		return errors.New("Price exceeds " + strconv.Itoa(s.PricePrecision) + " decimal places")
+	}
+
+	if o.Amount.Places() > s.AmountPrecision {
+		return errors.New("Amount exceeds " + strconv.Itoa(s.AmountPrecision) + " decimal places")
+	}
+
+	if !o.Price.IsMultipleOf(s.TickSize) {
+		return errors.New("Price " + o.Price.String() + " is not a multiple of the tick size " + s.TickSize.String())
+	}
+
+	if o.StopPrice.Places() > s.PricePrecision || !o.StopPrice.IsMultipleOf(s.TickSize) {
+		return errors.New("Stop price " + o.StopPrice.String() + " does not fit the tick size " + s.TickSize.String())
+	}
+
+	if !o.DisplayAmount.IsMultipleOf(s.LotSize) || o.DisplayAmount.GreaterThan(o.Amount) {
+		return errors.New("Display amount " + o.DisplayAmount.String() + " must be a lot multiple within the amount")
+	}
+
+	if !o.Amount.IsMultipleOf(s.LotSize) {
+		return errors.New("Amount " + o.Amount.String() + " is not a multiple of the lot size " + s.LotSize.String())
+	}
+
+	if o.Amount.LessThan(s.MinAmount) {
+		return errors.New("Amount " + o.Amount.String() + " is below the minimum of " + s.MinAmount.String())
+	}
+
+	if s.MaxAmount.IsPositive() && o.Amount.GreaterThan(s.MaxAmount) {
+		return errors.New("Amount " + o.Amount.String() + " is above the maximum of " + s.MaxAmount.String())
+	}
+
+	notional, err := o.Price.CheckedMul(o.Amount)
+
+	if err != nil {
+		return errors.New("Order value is out of range")
+	}
+
+	// the notional of a market order is unknown until it trades
+	if !o.IsMarket() && notional.LessThan(s.MinNotional) {
+		return errors.New("Order value " + notional.String() + " is below the minimum of " + s.MinNotional.String())
+	}
+
+	return nil
 }
@@ -0,0 +1,38 @@
+package models
+
+const (
+	// the shares put in circulation when the stock is issued
+	SUPPLY_ISSUE = "ISSUE"
+	// new shares issued to holders after the stock is listed
+	SUPPLY_OFFERING = "OFFERING"
+	// shares bought back from a holder and taken out of circulation
+	SUPPLY_BUYBACK = "BUYBACK"
+	// every share split into new shares, or merged for a reverse split
+	SUPPLY_SPLIT = "SPLIT"
+	// new shares paid to holders as a dividend
+	SUPPLY_DIVIDEND = "DIVIDEND"
+)
+
+// An allocation credits a holder account with shares of a stock
+type Allocation struct {
+	AccountId string  `json:"account_id"`
+	Amount    Decimal `json:"amount"`
+}
+
+func NewAllocation(id string, amount Decimal) *Allocation {
+	return &Allocation{
+		AccountId: id,
+		Amount:    amount,
+	}
+}
+
+// A supply event records a change in the shares of a stock and the
+// supply that results from it
+type SupplyEvent struct {
+	Kind              string        `json:"kind"`
+	StockCode         string        `json:"stock_code"`
+	Allocations       []*Allocation `json:"allocations"`
+	TotalSupply       Decimal       `json:"total_supply"`
+	CirculatingSupply Decimal       `json:"circulating_supply"`
+	Timestamp         int64         `json:"timestamp"`
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"sync"
+)
+
+func NewTriggerBook() *TriggerBook {
+	return &TriggerBook{
+		orders: []*Order{},
+	}
+}
+
+// A trigger book holds the stop orders of a market apart from its
+// queues, they are released in time priority once the last trade
+// price reaches their stop price
+type TriggerBook struct {
+	last   Decimal
+	orders []*Order
+	sync.RWMutex
+}
+
+func (tb *TriggerBook) Add(o *Order) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	o.Trail(tb.last)
+	tb.orders = append(tb.orders, o)
+}
+
+// Remove a stop order, nil if it is not in the book
+func (tb *TriggerBook) Remove(id string) *Order {
+	tb.Lock()
+	defer tb.Unlock()
+
+	for i, o := range tb.orders {
+		if o.OrderId == id {
+			tb.orders = append(tb.orders[:i], tb.orders[i+1:]...)
+			return o
+		}
+	}
+
+	return nil
+}
+
+func (tb *TriggerBook) Find(id string) *Order {
+	tb.RLock()
+	defer tb.RUnlock()
+
+	for _, o := range tb.orders {
+		if o.OrderId == id {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// Call fn on every stop order in time priority until it returns false
+func (tb *TriggerBook) Range(fn func(o *Order) bool) {
+	tb.RLock()
+	defer tb.RUnlock()
+
+	for _, o := range tb.orders {
+		if !fn(o) {
+			return
+		}
+	}
+}
+
+// Record the last trade price, trailing stops follow it
+func (tb *TriggerBook) Follow(price Decimal) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	tb.last = price
+
+	for _, o := range tb.orders {
+		o.Trail(price)
+	}
+}
+
+func (tb *TriggerBook) Last() Decimal {
+	tb.RLock()
+	defer tb.RUnlock()
+	return tb.last
+}
+
+// Remove and return the stop orders triggered by the last trade price
+func (tb *TriggerBook) Release() []*Order {
+	tb.Lock()
+	defer tb.Unlock()
+
+	var (
+		released = []*Order{}
+		waiting  = tb.orders[:0]
+	)
+
+	for _, o := range tb.orders {
+		if o.Triggers(tb.last) {
+			released = append(released, o)
+		} else {
+			waiting = append(waiting, o)
+		}
+	}
+
+	tb.orders = waiting
+	return released
+}
+
+// Rescale the stop orders and the last trade price for a split giving
+// to new shares for every from shares. The orders left with nothing
+// are taken out of the book and returned
+func (tb *TriggerBook) Split(from, to int64, tick, lot Decimal) []*Order {
+	tb.Lock()
+	defer tb.Unlock()
+
+	var (
+		kept    = []*Order{}
+		dropped = []*Order{}
+	)
+
+	tb.last, _ = tb.last.Scale(from, to)
+
+	for _, o := range tb.orders {
+		if o.Split(from, to, tick, lot) {
+			kept = append(kept, o)
+		} else {
+			dropped = append(dropped, o)
+		}
+	}
+
+	tb.orders = kept
+	return dropped
+}
+
+// Remove and return every stop order
+func (tb *TriggerBook) Drain() []*Order {
+	tb.Lock()
+	defer tb.Unlock()
+
+	drained := tb.orders
+	tb.orders = []*Order{}
+	return drained
+}
+
+func (tb *TriggerBook) Len() int {
+	tb.RLock()
+	defer tb.RUnlock()
+	return len(tb.orders)
+}
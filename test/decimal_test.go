@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	. "github.com/gravel/models"
+	"testing"
+)
+
+func TestDecimalArithmetic(t *testing.T) {
+	var (
+		amount = NewDecimal(1)
+		fill   = NewDecimal(0.1)
+	)
+
+	// ten partial fills of 0.1 leave no dust behind
+	for i := 0; i < 10; i++ {
+		amount = amount.Sub(fill)
+	}
+
+	if !amount.IsZero() {
+		t.Error("Expected zero after partial fills, got", amount)
+	}
+
+	cases := []struct {
+		got      Decimal
+		expected string
+	}{
+		{NewDecimal(10.000000002), "10"},
+		{NewDecimal(0.1).Add(NewDecimal(0.2)), "0.3"},
+		{NewDecimal(10.25).Mul(NewDecimal(4)), "41"},
+		{NewDecimal(1).Div(NewDecimal(3)), "0.33333333"},
+		{NewDecimal(2).Div(NewDecimal(3)), "0.66666667"},
+		{NewDecimal(-2).Div(NewDecimal(3)), "-0.66666667"},
+		{NewDecimal(10.125).Round(2), "10.13"},
+		{NewDecimal(-10.125).Round(2), "-10.13"},
+		{NewDecimal(0.00000005), "0.00000005"},
+	}
+
+	for _, c := range cases {
+		if c.got.String() != c.expected {
+			t.Error("Expected", c.expected, "got", c.got)
+		}
+	}
+
+	if NewDecimal(10.25).Places() != 2 || NewDecimal(100).Places() != 0 {
+		t.Error("Expected decimal places to count significant digits")
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	for _, s := range []string{"10.12345678", "-0.5", "0", "92233720368.54775807"} {
+		var d Decimal
+
+		if err := json.Unmarshal([]byte(s), &d); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := json.Marshal(d)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != s {
+			t.Error("Expected", s, "to round trip, got", string(data))
+		}
+	}
+
+	var order Order
+
+	if err := json.Unmarshal([]byte(`{"price":"1e-7","amount":0.3}`), &order); err != nil {
+		t.Fatal(err)
+	}
+
+	if order.Price.String() != "0.0000001" || order.Amount != NewDecimal(0.3) {
+		t.Error("Expected exact decimals, got", order.Price, order.Amount)
+	}
+
+	for _, s := range []string{"0.000000001", "1/3", "abc", "1e20"} {
+		if _, err := ParseDecimal(s); err == nil {
+			t.Error("Expected", s, "to be rejected")
+		}
+	}
+}
+
+func TestDecimalOverflow(t *testing.T) {
+	if _, err := NewDecimalFromInt(100000).CheckedMul(NewDecimalFromInt(1000000)); err == nil {
+		t.Error("Expected a product out of range to fail")
+	}
+
+	if _, err := NewDecimalFromInt(10000000).CheckedMul(NewDecimalFromInt(-1000000)); err == nil {
+		t.Error("Expected a negative product out of range to fail")
+	}
+
+	if _, err := NewDecimalFromInt(10000000000).CheckedDiv(NewDecimal(0.00000001)); err == nil {
+		t.Error("Expected a quotient out of range to fail")
+	}
+
+	if _, err := One.CheckedDiv(Zero); err == nil {
+		t.Error("Expected a division by zero to fail")
+	}
+
+	if d, err := NewDecimalFromInt(100000).CheckedMul(NewDecimalFromInt(100000)); err != nil || d != NewDecimalFromInt(10000000000) {
+		t.Error("Expected a product in range, got", d, err)
+	}
+
+	if _, err := NewDecimalFromInt(90000000000).CheckedAdd(NewDecimalFromInt(90000000000)); err == nil {
+		t.Error("Expected a sum out of range to fail")
+	}
+
+	if _, err := NewDecimalFromInt(-90000000000).CheckedSub(NewDecimalFromInt(90000000000)); err == nil {
+		t.Error("Expected a difference out of range to fail")
+	}
+
+	if d, err := NewDecimalFromInt(-1).CheckedSub(NewDecimalFromInt(-3)); err != nil || d != NewDecimalFromInt(2) {
+		t.Error("Expected a difference in range, got", d, err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected an integer out of range to panic rather than wrap")
+			}
+		}()
+
+		NewDecimalFromInt(100000000000)
+	}()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected an overflowing product to panic rather than wrap")
+		}
+	}()
+
+	NewDecimalFromInt(100000).Mul(NewDecimalFromInt(1000000))
+}
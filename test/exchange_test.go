@@ -1,9 +1,12 @@
 package test
 
 import (
+	"encoding/json"
 	. "github.com/gravel/exchange"
 	. "github.com/gravel/models"
 	"math/rand"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,11 +16,10 @@ func TestExchange(t *testing.T) {
 		NAME        = "Test_Stock_Name"
 		CODE        = "Test_Code"
 		DESCRIPTION = "Test_Description"
-		TOTAL       = 100000
-		CIRCULATING = 90000
+		TOTAL       = 10000000000
+		CIRCULATING = 10000000000
 		REF         = "/Test_Link"
-		MARKET_ASK  = "ASK"
-		MARKET_BID  = "BID"
+		MARKET      = "USD"
 	)
 
 	var (
@@ -25,12 +27,13 @@ func TestExchange(t *testing.T) {
 			NAME,
 			CODE,
 			DESCRIPTION,
-			TOTAL,
-			CIRCULATING,
+			NewDecimalFromInt(TOTAL),
+			NewDecimalFromInt(CIRCULATING),
 			REF,
 		)
 		exchange = NewExchange()
 		r        = rand.New(rand.NewSource(99))
+		stopped  = make(chan struct{})
 	)
 
 	for i := 0; i < 10; i++ {
@@ -39,18 +42,25 @@ func TestExchange(t *testing.T) {
 
 	go exchange.Start()
 
-	exchange.Issue(stock)
+	issueTestStock(exchange, stock, "Test_Account")
 
 	go func() {
 		for {
 			err := exchange.Buy(
+				"Test_Account",
 				CODE,
-				MARKET_BID,
-				15,
-				15,
+				MARKET,
+				NewDecimal(15),
+				NewDecimal(15),
 			)
+			// orders are rejected once the exchange is stopped
 			if err != nil {
-				panic(err)
+				select {
+				case <-stopped:
+					return
+				default:
+					panic(err)
+				}
 			}
 		}
 	}()
@@ -58,13 +68,20 @@ func TestExchange(t *testing.T) {
 	go func() {
 		for {
 			err := exchange.Sell(
+				"Test_Account",
 				CODE,
-				MARKET_ASK,
-				10+r.Float64()*10,
-				10+r.Float64()*10,
+				MARKET,
+				NewDecimal(10+r.Float64()*10),
+				NewDecimal(10+r.Float64()*10),
 			)
+			// orders are rejected once the exchange is stopped
 			if err != nil {
-				panic(err)
+				select {
+				case <-stopped:
+					return
+				default:
+					panic(err)
+				}
 			}
 		}
 	}()
@@ -76,5 +93,2401 @@ func TestExchange(t *testing.T) {
 		t.Log(*his)
 	}
 
+	close(stopped)
 	exchange.Stop()
 }
+
+func TestExchangeConsistentFills(t *testing.T) {
+	const (
+		CODE   = "Test_Code"
+		ORDERS = 40
+	)
+
+	var (
+		exchange = NewExchange()
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < 10; i++ {
+		exchange.Register(NewBroker())
+	}
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < ORDERS; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	waitDeals(exchange, ORDERS)
+
+	// give a racing broker the chance to produce extra fills
+	<-time.After(100 * time.Millisecond)
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if len(summary.Histories) != ORDERS {
+		t.Error("Expected", ORDERS, "deals, got", len(summary.Histories))
+	}
+
+	for _, deal := range summary.Histories {
+		if deal.Amount != NewDecimal(1) {
+			t.Error("Expected every deal to fill a whole order, got", deal.Amount)
+		}
+	}
+
+	if summary.Depth[ORDER_TYPE_ASK].Best() != nil || summary.Depth[ORDER_TYPE_BID].Best() != nil {
+		t.Error("Expected both queues to be fully matched")
+	}
+}
+
+func TestExchangeMarketOrder(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, price := range []float64{10, 11, 20} {
+		if err := exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(price), NewDecimal(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// slippage of 20% stops the sweep before the ask at 20
+	if err := exchange.BuyMarket("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(5), NewDecimal(0.2)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeals(exchange, 2)
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if len(summary.Histories) != 2 {
+		t.Fatal("Expected 2 deals, got", len(summary.Histories))
+	}
+
+	for i, price := range []float64{10, 11} {
+		if summary.Histories[i].Price != NewDecimal(price) {
+			t.Error("Expected deal at", price, "got", summary.Histories[i].Price)
+		}
+	}
+
+	if n, _ := resting(summary, ORDER_TYPE_ASK); n != 1 {
+		t.Error("Expected 1 resting ask, got", n)
+	}
+
+	// the unfilled remainder of a market order never rests
+	if n, _ := resting(summary, ORDER_TYPE_BID); n != 0 {
+		t.Error("Expected no resting bid, got", n)
+	}
+
+	if err := exchange.SellMarket("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(1), NewDecimal(-1)); err == nil {
+		t.Error("Expected negative slippage to be rejected")
+	}
+}
+
+func TestExchangePrecision(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+	)
+
+	stock.PricePrecision = 2
+	stock.AmountPrecision = 0
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, stock, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.25), NewDecimal(3)); err != nil {
+		t.Error(err)
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.255), NewDecimal(3)); err == nil {
+		t.Error("Expected a price beyond the stock precision to be rejected")
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.25), NewDecimal(0.5)); err == nil {
+		t.Error("Expected an amount beyond the stock precision to be rejected")
+	}
+}
+
+// Wait until the first book has recorded n deals or a timeout expires
+func waitDeals(exchange *Exchange, n int) {
+	deadline := time.Now().Add(3 * time.Second)
+
+	for len(exchange.Broadcast().Summaries[0].Histories) < n && time.Now().Before(deadline) {
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestExchangeTradingRules(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+	)
+
+	stock.TickSize = NewDecimal(0.05)
+	stock.LotSize = NewDecimal(10)
+	stock.MinAmount = NewDecimal(20)
+	stock.MaxAmount = NewDecimal(1000)
+	stock.MinNotional = NewDecimal(500)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, stock, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		price, amount float64
+		ok            bool
+	}{
+		{25.05, 20, true},
+		{25.02, 20, false},   // off tick
+		{25.05, 25, false},   // off lot
+		{25.05, 10, false},   // below minimum amount
+		{25.05, 1010, false}, // above maximum amount
+		{10, 40, false},      // below minimum notional
+		{0, 20, false},
+		{25.05, 0, false},
+	}
+
+	for _, c := range cases {
+		err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(c.price), NewDecimal(c.amount))
+
+		if c.ok && err != nil {
+			t.Error("Expected", c.price, c.amount, "to be accepted, got", err)
+		}
+
+		if !c.ok && err == nil {
+			t.Error("Expected", c.price, c.amount, "to be rejected")
+		}
+	}
+
+	if err := exchange.BuyMarket("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(25), NewDecimal(0)); err == nil {
+		t.Error("Expected a market order off lot to be rejected")
+	}
+}
+
+func TestExchangeTimeInForce(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// not enough quantity on the book, the order is killed untouched
+	fok := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(5))
+	fok.Owner = "Test_Account"
+	fok.TimeInForce = TIME_IN_FORCE_FOK
+	if err := exchange.Place(fok); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Order != fok || notice.Order.Amount != NewDecimal(5) {
+		t.Fatal("Expected the FOK order to expire unfilled")
+	}
+
+	// fills what it can and cancels the rest
+	ioc := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(3))
+	ioc.Owner = "Test_Account"
+	ioc.TimeInForce = TIME_IN_FORCE_IOC
+	if err := exchange.Place(ioc); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Order != ioc || notice.Order.Amount != NewDecimal(1) {
+		t.Fatal("Expected the IOC remainder to expire")
+	}
+
+	gtd := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(5), NewDecimal(1))
+	gtd.Owner = "Test_Account"
+	gtd.TimeInForce = TIME_IN_FORCE_GTD
+	gtd.ExpireTs = time.Now().Unix() + 1
+	if err := exchange.Place(gtd); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Order != gtd {
+		t.Fatal("Expected the GTD order to expire")
+	}
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if len(summary.Histories) != 1 || summary.Histories[0].Amount != NewDecimal(2) {
+		t.Error("Expected a single deal of 2")
+	}
+
+	if summary.Depth[ORDER_TYPE_ASK].Best() != nil || summary.Depth[ORDER_TYPE_BID].Best() != nil {
+		t.Error("Expected both queues to be empty")
+	}
+
+	past := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(5), NewDecimal(1))
+	past.Owner = "Test_Account"
+	past.TimeInForce = TIME_IN_FORCE_GTD
+	past.ExpireTs = time.Now().Unix() - 1
+	if err := exchange.Place(past); err == nil {
+		t.Error("Expected an expiry in the past to be rejected")
+	}
+
+	market := NewMarketOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(1), NewDecimal(0))
+	market.Owner = "Test_Account"
+	market.TimeInForce = TIME_IN_FORCE_GTC
+	if err := exchange.Place(market); err == nil {
+		t.Error("Expected a resting market order to be rejected")
+	}
+}
+
+// Wait for the next notice of the exchange, nil on timeout
+func waitNotice(exchange *Exchange) *Message {
+	select {
+	case notice := <-exchange.Notices():
+		return notice
+	case <-time.After(3 * time.Second):
+		return nil
+	}
+}
+
+// The displayed level of a side of a summary at the price, nil when
+// nothing is displayed there
+func depthAt(summary *Summary, side string, price Decimal) *DepthLevel {
+	for _, level := range summary.Depth[side].Items {
+		if level.Price == price {
+			return level
+		}
+	}
+	return nil
+}
+
+// The number of displayed orders on a side of a summary and their
+// amount
+func resting(summary *Summary, side string) (int, Decimal) {
+	var (
+		n      int
+		amount = Zero
+	)
+
+	for _, level := range summary.Depth[side].Items {
+		n += level.Count
+		amount = amount.Add(level.Amount)
+	}
+
+	return n, amount
+}
+
+func TestExchangeCancel(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(3))
+	ask.Owner = "Test_Account"
+
+	if err := exchange.Place(ask); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exchange.Cancel(CODE, ask.OrderId, "Test_Other_Owner"); err == nil {
+		t.Error("Expected an order of another owner not to be cancelled")
+	}
+
+	cancelled, err := exchange.Cancel(CODE, ask.OrderId, "Test_Account")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cancelled.Amount != NewDecimal(2) {
+		t.Error("Expected remaining amount 2, got", cancelled.Amount)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_CANCELLED || notice.Order != ask {
+		t.Error("Expected a cancellation notice for the owner")
+	}
+
+	if _, err := exchange.Cancel(CODE, ask.OrderId); err == nil {
+		t.Error("Expected a cancelled order not to be cancelled twice")
+	}
+
+	if exchange.Broadcast().Summaries[0].Depth[ORDER_TYPE_ASK].Best() != nil {
+		t.Error("Expected the ask queue to be empty")
+	}
+}
+
+func TestExchangeStop(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(3))
+	ask.Owner = "Test_Account"
+
+	if err := exchange.Place(ask); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Stop()
+
+	if _, err := exchange.Cancel(CODE, ask.OrderId, "Test_Account"); err == nil {
+		t.Error("Expected a cancel after the exchange stopped to fail")
+	}
+
+	if err := exchange.Halt(CODE, "Test_Reason"); err == nil {
+		t.Error("Expected a halt after the exchange stopped to fail")
+	}
+
+	// more orders than a broker buffers must not block
+	for i := 0; i < REQUEST_BUFFER_SIZE+1; i++ {
+		if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(1), NewDecimal(1)); err == nil {
+			t.Fatal("Expected an order after the exchange stopped to be rejected")
+		}
+	}
+}
+
+func TestExchangeAmend(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(2))
+	first.Owner = "Test_Account"
+	second := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(2))
+	second.Owner = "Test_Account"
+	third := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(2))
+	third.Owner = "Test_Account"
+
+	for _, o := range []*Order{first, second, third} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reducing the amount keeps the priority
+	if amended, err := exchange.Amend(CODE, first.OrderId, NewDecimal(10), NewDecimal(1)); err != nil || amended.Amount != NewDecimal(1) {
+		t.Fatal("Expected the amount to be reduced", err)
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	waitDeals(exchange, 1)
+
+	if deal := exchange.Broadcast().Summaries[0].Histories[0]; deal.AskOrderId != first.OrderId {
+		t.Error("Expected a reduced order to keep its priority")
+	}
+
+	// increasing the amount loses the priority
+	if _, err := exchange.Amend(CODE, second.OrderId, NewDecimal(10), NewDecimal(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	waitDeals(exchange, 2)
+
+	if deal := exchange.Broadcast().Summaries[0].Histories[1]; deal.AskOrderId != third.OrderId {
+		t.Error("Expected an increased order to lose its priority")
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(9), NewDecimal(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new price crossing the book trades immediately
+	if amended, err := exchange.Amend(CODE, second.OrderId, NewDecimal(9), NewDecimal(2)); err != nil || amended.Amount != NewDecimal(1) {
+		t.Fatal("Expected the amended order to trade", err)
+	}
+
+	if asks := exchange.Broadcast().Summaries[0].Depth[ORDER_TYPE_ASK]; len(asks.Items) != 2 || asks.Best().Price != NewDecimal(9) || asks.Best().Amount != NewDecimal(1) {
+		t.Error("Expected the remainder of the amended order to rest at its new price")
+	}
+
+	if _, err := exchange.Amend(CODE, second.OrderId, NewDecimal(9), NewDecimal(0)); err == nil {
+		t.Error("Expected a zero amount to be rejected")
+	}
+
+	if _, err := exchange.Amend(CODE, "Test_Missing_Order", NewDecimal(10), NewDecimal(1)); err == nil {
+		t.Error("Expected a missing order to be rejected")
+	}
+}
+
+func TestExchangeDealSides(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	bid := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	bid.Owner = "Test_Account"
+	ask := NewMarketOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(1), NewDecimal(0))
+	ask.Owner = "Test_Account"
+
+	for _, o := range []*Order{bid, ask} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitDeals(exchange, 1)
+
+	histories := exchange.Broadcast().Summaries[0].Histories
+
+	if len(histories) != 1 {
+		t.Fatal("Expected 1 deal, got", len(histories))
+	}
+
+	deal := histories[0]
+
+	if deal.AskOrderId != ask.OrderId || deal.BidOrderId != bid.OrderId {
+		t.Error("Expected the deal to identify both orders")
+	}
+
+	if deal.Maker != ORDER_TYPE_BID || deal.Taker != ORDER_TYPE_ASK {
+		t.Error("Expected the resting bid to be the maker, got", deal.Maker)
+	}
+
+	if deal.StockCode != CODE || deal.TradeId == "" {
+		t.Error("Expected the deal to carry its stock code and trade id")
+	}
+
+	if deal.Price != NewDecimal(10) {
+		t.Error("Expected a market ask to trade at the bid price, got", deal.Price)
+	}
+}
+
+func TestExchangeMakerPricing(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	stock := newTestStock(CODE)
+	stock.TickSize = NewDecimal(0.01)
+
+	if err := issueTestStock(exchange, stock, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an aggressive seller trades at the resting bid
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(9), NewDecimal(1))
+
+	waitDeals(exchange, 1)
+
+	if err := exchange.SetPricing(CODE, MidpointPricing); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(8), NewDecimal(1))
+
+	waitDeals(exchange, 2)
+
+	histories := exchange.Broadcast().Summaries[0].Histories
+
+	if len(histories) != 2 {
+		t.Fatal("Expected 2 deals, got", len(histories))
+	}
+
+	if histories[0].Price != NewDecimal(10) {
+		t.Error("Expected the maker price 10, got", histories[0].Price)
+	}
+
+	if histories[1].Price != NewDecimal(9) {
+		t.Error("Expected the midpoint price 9, got", histories[1].Price)
+	}
+
+	// a midpoint between two adjacent ticks moves onto the maker's price
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.02), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.01), NewDecimal(1))
+
+	waitDeals(exchange, 3)
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.01), NewDecimal(1))
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10.02), NewDecimal(1))
+
+	waitDeals(exchange, 4)
+
+	histories = exchange.Broadcast().Summaries[0].Histories
+
+	if len(histories) != 4 {
+		t.Fatal("Expected 4 deals, got", len(histories))
+	}
+
+	if histories[2].Price != NewDecimal(10.02) {
+		t.Error("Expected the midpoint to move onto the resting bid 10.02, got", histories[2].Price)
+	}
+
+	if histories[3].Price != NewDecimal(10.01) {
+		t.Error("Expected the midpoint to move onto the resting ask 10.01, got", histories[3].Price)
+	}
+}
+
+func newTestStock(code string) *Stock {
+	return NewStock(
+		"Test_Stock_Name",
+		code,
+		"Test_Description",
+		NewDecimalFromInt(100000),
+		NewDecimalFromInt(90000),
+		"/Test_Link",
+	)
+}
+
+func TestExchangeMarkets(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+	)
+
+	stock.Markets = []string{"USD", "BTC"}
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, stock, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	// orders of different markets never cross
+	exchange.Sell("Test_Account", CODE, "USD", NewDecimal(10), NewDecimal(1))
+	exchange.Buy("Test_Account", CODE, "BTC", NewDecimal(10), NewDecimal(1))
+	exchange.Buy("Test_Account", CODE, "USD", NewDecimal(10), NewDecimal(1))
+
+	waitDeals(exchange, 1)
+
+	summaries := exchange.Broadcast().Summaries
+
+	if len(summaries) != 2 {
+		t.Fatal("Expected a summary per market, got", len(summaries))
+	}
+
+	usd, btc := summaries[0], summaries[1]
+
+	if usd.Market != "USD" || btc.Market != "BTC" || usd.StockCode != CODE {
+		t.Fatal("Expected the summaries to identify their markets")
+	}
+
+	if len(usd.Histories) != 1 || usd.Histories[0].Market != "USD" {
+		t.Error("Expected a single deal in USD")
+	}
+
+	if n, _ := resting(btc, ORDER_TYPE_BID); len(btc.Histories) != 0 || n != 1 {
+		t.Error("Expected the BTC bid to rest untouched")
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, "ETH", NewDecimal(10), NewDecimal(1)); err == nil {
+		t.Error("Expected an unknown market to be rejected")
+	}
+}
+
+// List a stock with its circulating shares split evenly between the
+// holders, each of which is funded with cash
+func issueTestStock(exchange *Exchange, stock *Stock, holders ...string) error {
+	var (
+		share       = stock.CirculatingSupply.Div(NewDecimalFromInt(int64(len(holders))))
+		allocations = []*Allocation{}
+	)
+
+	for _, id := range holders {
+		allocations = append(allocations, NewAllocation(id, share))
+	}
+
+	if err := exchange.Issue(stock, allocations...); err != nil {
+		return err
+	}
+
+	for _, id := range holders {
+		fundTestAccount(exchange, id)
+	}
+
+	return nil
+}
+
+func fundTestAccount(exchange *Exchange, id string) {
+	for _, asset := range []string{"USD", "BTC"} {
+		exchange.Ledger().Deposit(id, asset, NewDecimalFromInt(10000000000))
+	}
+}
+
+func TestExchangeLedger(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		ledger   = exchange.Ledger()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := exchange.Issue(
+		newTestStock(CODE),
+		NewAllocation("Test_Seller", NewDecimal(5)),
+		NewAllocation("Test_Holder", NewDecimalFromInt(89995)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger.Open("Test_Buyer")
+	ledger.Deposit("Test_Buyer", DEFAULT_MARKET, NewDecimal(100))
+
+	// the total of an asset never leaves the range of a decimal
+	ledger.Open("Test_Rich")
+
+	if err := ledger.Deposit("Test_Rich", "BTC", NewDecimalFromInt(90000000000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ledger.Deposit("Test_Buyer", "BTC", NewDecimalFromInt(90000000000)); err == nil {
+		t.Error("Expected a deposit out of range to be rejected")
+	}
+
+	if err := exchange.Buy("Test_Buyer", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(11)); err == nil {
+		t.Error("Expected a bid beyond the cash of the account to be rejected")
+	}
+
+	if err := exchange.Sell("Test_Nobody", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err == nil {
+		t.Error("Expected an order of an unknown account to be rejected")
+	}
+
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(5))
+	ask.Owner = "Test_Seller"
+
+	if err := exchange.Place(ask); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Buy("Test_Buyer", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeals(exchange, 1)
+
+	if _, err := exchange.Cancel(CODE, ask.OrderId, "Test_Seller"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id, asset       string
+		available, held float64
+	}{
+		{"Test_Seller", CODE, 3, 0},
+		{"Test_Seller", DEFAULT_MARKET, 20, 0},
+		{"Test_Buyer", CODE, 2, 0},
+		{"Test_Buyer", DEFAULT_MARKET, 80, 0},
+	} {
+		balance, err := ledger.Balance(c.id, c.asset)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if balance.Available != NewDecimal(c.available) || balance.Held != NewDecimal(c.held) {
+			t.Error("Unexpected balance of", c.id, c.asset, balance.Available, balance.Held)
+		}
+	}
+
+	// the rounded totals of both fills come to more than the bid holds
+	for i := 0; i < 2; i++ {
+		exchange.Sell("Test_Seller", CODE, DEFAULT_MARKET, NewDecimal(0.33333333), NewDecimal(0.5))
+	}
+
+	exchange.Buy("Test_Buyer", CODE, DEFAULT_MARKET, NewDecimal(0.33333333), NewDecimal(1))
+	waitDeals(exchange, 3)
+
+	if cash, _ := ledger.Balance("Test_Buyer", DEFAULT_MARKET); cash.Held != Zero || cash.Available != NewDecimal(79.66666667) {
+		t.Error("Expected the bid to pay what it held, got", cash.Available, cash.Held)
+	}
+
+	// a market bid holds the cash only once the broker executes it
+	for i := 0; i < 2; i++ {
+		if err := exchange.BuyMarket("Test_Buyer", CODE, DEFAULT_MARKET, NewDecimal(1), Zero); err != nil {
+			t.Error("Expected market bids placed together to be accepted", err)
+		}
+	}
+
+	// a cancel is served after every order queued before it
+	exchange.Cancel(CODE, "Test_Unknown", "")
+
+	if cash, _ := ledger.Balance("Test_Buyer", DEFAULT_MARKET); cash.Held != Zero || cash.Available != NewDecimal(79.66666667) {
+		t.Error("Expected the cash of the unfilled market bids released, got", cash.Available, cash.Held)
+	}
+}
+
+func TestExchangeFees(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		ledger   = exchange.Ledger()
+		fees     = NewFeeSchedule(NewDecimal(0.001), NewDecimal(0.002))
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := exchange.Issue(
+		newTestStock(CODE),
+		NewAllocation("Test_Seller", NewDecimal(10)),
+		NewAllocation("Test_Holder", NewDecimalFromInt(89990)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rate must be a fraction of what a side receives
+	for _, rate := range []float64{1, -1, 1.5} {
+		if err := exchange.SetFees(CODE, NewFeeSchedule(NewDecimal(rate), Zero)); err == nil {
+			t.Error("Expected a fee rate of", rate, "to be rejected")
+		}
+	}
+
+	// market makers earn a rebate, paid out of the fee account
+	fees.SetTier("Test_Tier", NewDecimal(-0.001), NewDecimal(0.002))
+
+	if err := exchange.SetFees(CODE, fees); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger.Open("Test_Buyer")
+	ledger.SetTier("Test_Seller", "Test_Tier")
+	ledger.Deposit("Test_Buyer", DEFAULT_MARKET, NewDecimal(1000))
+	ledger.Deposit(FEE_ACCOUNT, DEFAULT_MARKET, NewDecimal(0.4))
+
+	exchange.Sell("Test_Seller", CODE, DEFAULT_MARKET, NewDecimal(100), NewDecimal(10))
+	exchange.Buy("Test_Buyer", CODE, DEFAULT_MARKET, NewDecimal(100), NewDecimal(10))
+
+	waitDeals(exchange, 1)
+
+	deal := exchange.Broadcast().Summaries[0].Histories[0]
+
+	// the fee account holds less than the rebate of 1
+	if deal.MakerFee != NewDecimal(-0.4) || deal.TakerFee != NewDecimal(0.02) {
+		t.Error("Unexpected fees", deal.MakerFee, deal.TakerFee)
+	}
+
+	for _, c := range []struct {
+		id, asset string
+		available float64
+	}{
+		{"Test_Seller", DEFAULT_MARKET, 1000.4},
+		{"Test_Buyer", CODE, 9.98},
+		{FEE_ACCOUNT, DEFAULT_MARKET, 0},
+		{FEE_ACCOUNT, CODE, 0.02},
+	} {
+		balance, _ := ledger.Balance(c.id, c.asset)
+
+		if balance.Available != NewDecimal(c.available) {
+			t.Error("Expected", c.id, c.asset, c.available, "got", balance.Available)
+		}
+	}
+}
+
+func TestExchangeSelfTrade(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	for _, c := range []struct {
+		mode     string
+		notices  []string
+		ask, bid float64
+	}{
+		{SELF_TRADE_CANCEL_NEWEST, []string{MESSAGE_COMMAND_PREVENTED}, 2, 0},
+		{SELF_TRADE_CANCEL_OLDEST, []string{MESSAGE_COMMAND_PREVENTED}, 0, 3},
+		{SELF_TRADE_CANCEL_BOTH, []string{MESSAGE_COMMAND_PREVENTED, MESSAGE_COMMAND_PREVENTED}, 0, 0},
+		{SELF_TRADE_DECREMENT, []string{MESSAGE_COMMAND_PREVENTED, MESSAGE_COMMAND_DECREMENTED}, 0, 1},
+	} {
+		exchange := NewExchange()
+		exchange.Register(NewBroker())
+
+		go exchange.Start()
+
+		if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+			t.Fatal(err)
+		}
+
+		exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(2))
+
+		bid := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(3))
+		bid.Owner = "Test_Account"
+		bid.SelfTrade = c.mode
+
+		if err := exchange.Place(bid); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, command := range c.notices {
+			if notice := waitNotice(exchange); notice == nil || notice.Command != command {
+				t.Error(c.mode, "expected a notice", command)
+			}
+		}
+
+		summary := exchange.Broadcast().Summaries[0]
+
+		if len(summary.Histories) != 0 {
+			t.Error(c.mode, "expected no deal, got", len(summary.Histories))
+		}
+
+		for side, amount := range map[string]float64{ORDER_TYPE_ASK: c.ask, ORDER_TYPE_BID: c.bid} {
+			if _, resting := resting(summary, side); resting != NewDecimal(amount) {
+				t.Error(c.mode, "expected", amount, side, "resting, got", resting)
+			}
+		}
+
+		if cash, _ := exchange.Ledger().Balance("Test_Account", DEFAULT_MARKET); cash.Held != NewDecimal(c.bid*10) {
+			t.Error(c.mode, "expected", c.bid*10, "cash held, got", cash.Held)
+		}
+
+		exchange.Stop()
+	}
+
+	if err := NewExchange().Place(&Order{Owner: "Test_Account", SelfTrade: "Test_Mode"}); err == nil {
+		t.Error("Expected an unknown self trade prevention mode to be rejected")
+	}
+}
+
+func TestExchangeStopOrders(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account", "Test_Stop"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, price := range []float64{10, 11, 12} {
+		exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(price), NewDecimal(1))
+	}
+
+	stop := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(12), NewDecimal(1))
+	stop.Owner = "Test_Stop"
+	stop.StopPrice = NewDecimal(11)
+
+	if err := exchange.Place(stop); err != nil {
+		t.Fatal(err)
+	}
+
+	// a trade below the stop price leaves it waiting
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	waitDeals(exchange, 1)
+
+	if exchange.Broadcast().Summaries[0].Depth[ORDER_TYPE_BID].Best() != nil {
+		t.Error("Expected the stop order to wait in the trigger book")
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(11), NewDecimal(1))
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_TRIGGERED || notice.Order.OrderId != stop.OrderId {
+		t.Error("Expected the stop order to be triggered")
+	}
+
+	waitDeals(exchange, 3)
+
+	histories := exchange.Broadcast().Summaries[0].Histories
+
+	if len(histories) != 3 || histories[2].BidOrderId != stop.OrderId || histories[2].Price != NewDecimal(12) {
+		t.Error("Expected the triggered stop order to buy at 12")
+	}
+
+	// a waiting stop order is cancelled like any other
+	waiting := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(5), NewDecimal(1))
+	waiting.Owner = "Test_Stop"
+	waiting.TrailAmount = NewDecimal(2)
+
+	if err := exchange.Place(waiting); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exchange.Cancel(CODE, waiting.OrderId, "Test_Stop"); err != nil {
+		t.Error("Expected a waiting stop order to be cancelled", err)
+	}
+
+	if waiting.StopPrice != NewDecimal(10) {
+		t.Error("Expected the trailing stop at 10, got", waiting.StopPrice)
+	}
+
+	// a waiting stop market bid holds no cash until it is triggered
+	exchange.Ledger().Open("Test_Funded")
+	exchange.Ledger().Deposit("Test_Funded", DEFAULT_MARKET, NewDecimal(100))
+
+	market := NewMarketOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(1), Zero)
+	market.Owner = "Test_Funded"
+	market.StopPrice = NewDecimal(20)
+
+	if err := exchange.Place(market); err != nil {
+		t.Fatal(err)
+	}
+
+	if cash, _ := exchange.Ledger().Balance("Test_Funded", DEFAULT_MARKET); cash.Available != NewDecimal(100) {
+		t.Error("Expected the stop market bid to hold nothing, got", cash.Held)
+	}
+
+	if err := exchange.Buy("Test_Funded", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(5)); err != nil {
+		t.Error("Expected the cash to remain available", err)
+	}
+}
+
+func TestOrderTrailingStop(t *testing.T) {
+	o := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, "Test_Code", NewDecimal(1), NewDecimal(1))
+	o.TrailPercent = NewDecimal(0.1)
+
+	for _, c := range []struct {
+		last, stop float64
+	}{
+		{100, 90},
+		{120, 108},
+		{100, 108},
+	} {
+		if o.Trail(NewDecimal(c.last)); o.StopPrice != NewDecimal(c.stop) {
+			t.Error("Expected stop price", c.stop, "got", o.StopPrice)
+		}
+	}
+
+	if o.Triggers(NewDecimal(109)) || !o.Triggers(NewDecimal(108)) {
+		t.Error("Expected a sell stop to trigger at or below its stop price")
+	}
+}
+
+func TestExchangeIceberg(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	iceberg := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(5))
+	iceberg.Owner = "Test_Account"
+	iceberg.DisplayAmount = NewDecimal(2)
+
+	if err := exchange.Place(iceberg); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+
+	// only the displayed slice trades before the later order
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(3))
+	waitDeals(exchange, 2)
+
+	summary := exchange.Broadcast().Summaries[0]
+	histories := summary.Histories
+
+	if len(histories) != 2 || histories[0].AskOrderId != iceberg.OrderId || histories[0].Amount != NewDecimal(2) || histories[1].AskOrderId == iceberg.OrderId {
+		t.Fatal("Expected the displayed slice to trade first and the later order next")
+	}
+
+	top := summary.Depth[ORDER_TYPE_ASK].Best()
+
+	if top == nil || top.Count != 1 || top.Amount != NewDecimal(2) {
+		t.Fatal("Expected a replenished slice of 2 on display")
+	}
+
+	data, _ := json.Marshal(summary)
+
+	if strings.Contains(string(data), `"hidden_amount":1`) {
+		t.Error("Expected the hidden amount not to be disclosed")
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(3))
+	waitDeals(exchange, 4)
+
+	if exchange.Broadcast().Summaries[0].Depth[ORDER_TYPE_ASK].Best() != nil {
+		t.Error("Expected the iceberg order to trade completely")
+	}
+}
+
+func TestExchangePostOnlyAndHidden(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	stock := newTestStock(CODE)
+	stock.TickSize = NewDecimal(0.5)
+
+	if err := issueTestStock(exchange, stock, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	hidden := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(1))
+	hidden.Owner = "Test_Account"
+	hidden.Hidden = true
+
+	if err := exchange.Place(hidden); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(11), NewDecimal(1))
+
+	displayed := exchange.Broadcast().Summaries[0]
+
+	for deadline := time.Now().Add(3 * time.Second); displayed.Depth[ORDER_TYPE_ASK].Best() == nil && time.Now().Before(deadline); {
+		<-time.After(10 * time.Millisecond)
+		displayed = exchange.Broadcast().Summaries[0]
+	}
+
+	if asks := displayed.Depth[ORDER_TYPE_ASK].Items; len(asks) != 1 || asks[0].Price != NewDecimal(11) || asks[0].Count != 1 {
+		t.Error("Expected the hidden order to be left out of the summary")
+	}
+
+	rejected := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	rejected.Owner = "Test_Account"
+	rejected.PostOnly = POST_ONLY_REJECT
+	exchange.Place(rejected)
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_REJECTED || notice.Order != rejected {
+		t.Error("Expected a crossing post-only order to be rejected")
+	}
+
+	repriced := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	repriced.Owner = "Test_Account"
+	repriced.PostOnly = POST_ONLY_REPRICE
+	exchange.Place(repriced)
+
+	// the hidden order still matches
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	waitDeals(exchange, 1)
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if summary.Histories[0].AskOrderId != hidden.OrderId {
+		t.Error("Expected the hidden order to trade")
+	}
+
+	if bid := depthAt(summary, ORDER_TYPE_BID, NewDecimal(9.5)); bid == nil || bid.Count != 1 {
+		t.Error("Expected the post-only order to rest repriced at 9.5")
+	}
+
+	market := NewMarketOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(1), Zero)
+	market.Owner = "Test_Account"
+	market.PostOnly = POST_ONLY_REJECT
+
+	if err := exchange.Place(market); err == nil {
+		t.Error("Expected a post-only market order to be rejected")
+	}
+}
+
+func TestExchangeAuction(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Uncross(CODE); err == nil {
+		t.Error("Expected no auction to uncross")
+	}
+
+	if err := exchange.OpenAuction(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	// demand 3 at 12, 5 at 11 and 6 at 10 against supply 2 at 9,
+	// 4 at 10 and 7 at 11, the volume is largest at 11
+	for _, o := range []struct {
+		side          string
+		price, amount float64
+	}{
+		{ORDER_TYPE_BID, 12, 3},
+		{ORDER_TYPE_BID, 11, 2},
+		{ORDER_TYPE_BID, 10, 1},
+		{ORDER_TYPE_ASK, 9, 2},
+		{ORDER_TYPE_ASK, 10, 2},
+		{ORDER_TYPE_ASK, 11, 3},
+	} {
+		order := NewOrder(DEFAULT_MARKET, o.side, CODE, NewDecimal(o.price), NewDecimal(o.amount))
+		order.Owner = "Test_Account"
+
+		if err := exchange.Place(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	market := NewMarketOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(1), Zero)
+	market.Owner = "Test_Account"
+	exchange.Place(market)
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_REJECTED {
+		t.Error("Expected a market order to be rejected during the auction")
+	}
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if len(summary.Histories) != 0 {
+		t.Error("Expected no deal during the auction")
+	}
+
+	if summary.Auction == nil || summary.Auction.Price != NewDecimal(11) || summary.Auction.Volume != NewDecimal(5) {
+		t.Fatal("Expected an indicative uncrossing of 5 at 11, got", summary.Auction)
+	}
+
+	if err := exchange.Uncross(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeals(exchange, 4)
+
+	var volume Decimal
+
+	for _, deal := range exchange.Broadcast().Summaries[0].Histories {
+		if deal.Price != NewDecimal(11) {
+			t.Error("Expected every deal at 11, got", deal.Price)
+		}
+		volume = volume.Add(deal.Amount)
+	}
+
+	if volume != NewDecimal(5) {
+		t.Error("Expected a volume of 5, got", volume)
+	}
+
+	if summary := exchange.Broadcast().Summaries[0]; summary.Auction != nil || summary.Depth[ORDER_TYPE_ASK].Best().Price != NewDecimal(11) {
+		t.Error("Expected continuous matching with the rest of the asks at 11")
+	}
+
+	// the uncrossing prevents the self trades the owners asked to
+	if err := exchange.OpenAuction(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	bid := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10.5), NewDecimal(1))
+	bid.Owner = "Test_Account"
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(1))
+	ask.Owner = "Test_Account"
+	ask.SelfTrade = SELF_TRADE_CANCEL_NEWEST
+
+	for _, o := range []*Order{bid, ask} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := exchange.Uncross(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	summary = exchange.Broadcast().Summaries[0]
+
+	if len(summary.Histories) != 4 || depthAt(summary, ORDER_TYPE_ASK, ask.Price) != nil || depthAt(summary, ORDER_TYPE_BID, bid.Price) == nil {
+		t.Error("Expected the newest order to be cancelled rather than trade with its owner")
+	}
+}
+
+func TestExchangeSessions(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		// a Monday
+		now      = time.Date(2026, time.January, 5, 7, 0, 0, 0, time.UTC)
+		clock    sync.Mutex
+		schedule = NewSchedule(
+			Session{Phase: PHASE_PRE_OPEN, Start: 8 * time.Hour},
+			Session{Phase: PHASE_OPENING_AUCTION, Start: 9 * time.Hour},
+			Session{Phase: PHASE_CONTINUOUS, Start: 9*time.Hour + 30*time.Minute},
+			Session{Phase: PHASE_CLOSING_AUCTION, Start: 16 * time.Hour},
+			Session{Phase: PHASE_CLOSED, Start: 16*time.Hour + 30*time.Minute},
+		)
+	)
+
+	exchange.Register(NewBroker())
+	exchange.SetClock(func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	})
+
+	advance := func(d time.Duration) {
+		clock.Lock()
+		now = now.Add(d)
+		clock.Unlock()
+		exchange.Tick()
+	}
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	schedule.AddHoliday(time.Date(2026, time.January, 6, 0, 0, 0, 0, time.UTC))
+
+	if err := exchange.SetSchedule(CODE, schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(phase string) {
+		select {
+		case event := <-exchange.Events():
+			if event.Command != MESSAGE_COMMAND_PHASE || event.Phase != phase || event.Stock.Code != CODE {
+				t.Error("Expected a transition to", phase, "got", event.Phase)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("Expected a transition to", phase)
+		}
+
+		if current, _ := exchange.Phase(CODE); current != phase {
+			t.Error("Expected phase", phase, "got", current)
+		}
+	}
+
+	expect(PHASE_CLOSED)
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err == nil {
+		t.Error("Expected an order to be rejected while closed")
+	}
+
+	advance(time.Hour)
+	expect(PHASE_PRE_OPEN)
+
+	// orders are queued until the market opens
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(9), NewDecimal(1))
+
+	advance(90 * time.Minute)
+	expect(PHASE_CONTINUOUS)
+
+	waitDeals(exchange, 1)
+
+	if summary := exchange.Broadcast().Summaries[0]; len(summary.Histories) != 1 || summary.Phase != PHASE_CONTINUOUS {
+		t.Error("Expected the queued orders to trade at the opening")
+	}
+
+	for _, c := range []struct {
+		at    time.Time
+		phase string
+	}{
+		{time.Date(2026, time.January, 5, 16, 0, 0, 0, time.UTC), PHASE_CLOSING_AUCTION},
+		{time.Date(2026, time.January, 5, 17, 0, 0, 0, time.UTC), PHASE_CLOSED},
+		{time.Date(2026, time.January, 6, 12, 0, 0, 0, time.UTC), PHASE_CLOSED},
+		{time.Date(2026, time.January, 7, 12, 0, 0, 0, time.UTC), PHASE_CONTINUOUS},
+		{time.Date(2026, time.January, 10, 12, 0, 0, 0, time.UTC), PHASE_CLOSED},
+	} {
+		if phase := schedule.Phase(c.at); phase != c.phase {
+			t.Error("Expected phase", c.phase, "at", c.at, "got", phase)
+		}
+	}
+}
+
+func TestExchangePriceBands(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account", "Test_Other"); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.SetBands(CODE, &PriceBands{
+		Reference: NewDecimal(100),
+		Static:    NewDecimal(0.1),
+		Dynamic:   NewDecimal(0.05),
+	})
+
+	if err := exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(200), NewDecimal(1)); err == nil {
+		t.Error("Expected a price outside the static band to be rejected")
+	}
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(100), NewDecimal(1))
+	exchange.Buy("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(100), NewDecimal(1))
+	waitDeals(exchange, 1)
+
+	// the second ask lies outside the dynamic band around 104
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(104), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(110), NewDecimal(1))
+	exchange.BuyMarket("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(2), Zero)
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_EXPIRED || notice.Order.Amount != NewDecimal(1) {
+		t.Error("Expected the market order to stop at the dynamic band")
+	}
+
+	waitDeals(exchange, 2)
+
+	if histories := exchange.Broadcast().Summaries[0].Histories; len(histories) != 2 || histories[1].Price != NewDecimal(104) {
+		t.Error("Expected a single trade within the dynamic band")
+	}
+
+	// a fill at 104.5 would move the band past the ask at 110, a FOK
+	// order for both is killed untouched
+	near := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(104.5), NewDecimal(1))
+	near.Owner = "Test_Account"
+
+	if err := exchange.Place(near); err != nil {
+		t.Fatal(err)
+	}
+
+	fok := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(110), NewDecimal(2))
+	fok.Owner = "Test_Other"
+	fok.TimeInForce = TIME_IN_FORCE_FOK
+
+	if err := exchange.Place(fok); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_EXPIRED || notice.Order.Amount != NewDecimal(2) {
+		t.Error("Expected the FOK order to expire unfilled at the dynamic band")
+	}
+
+	if _, err := exchange.Cancel(CODE, near.OrderId, "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_CANCELLED {
+		t.Error("Expected the ask to be cancelled")
+	}
+
+	exchange.SetBreaker(CODE, &CircuitBreaker{
+		Threshold: NewDecimal(0.03),
+		Period:    100 * time.Millisecond,
+	})
+
+	// a move from 104 to 108 halts the stock
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(108), NewDecimal(1))
+	exchange.Buy("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(108), NewDecimal(1))
+
+	for _, command := range []string{MESSAGE_COMMAND_HALT, MESSAGE_COMMAND_RESUME} {
+		select {
+		case event := <-exchange.Events():
+			if event.Command != command || event.Stock.Code != CODE {
+				t.Error("Expected a", command, "event, got", event.Command)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected a", command, "event")
+		}
+
+		if command == MESSAGE_COMMAND_HALT {
+			exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(109), NewDecimal(1))
+			exchange.Buy("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(109), NewDecimal(1))
+		}
+	}
+
+	// the orders queued while halted trade when the stock resumes
+	waitDeals(exchange, 4)
+
+	if summary := exchange.Broadcast().Summaries[0]; summary.Halted || len(summary.Histories) != 4 {
+		t.Error("Expected the queued orders to trade once resumed")
+	}
+
+	exchange.SetBreaker(CODE, &CircuitBreaker{
+		Threshold: NewDecimal(0.005),
+		Period:    100 * time.Millisecond,
+	})
+
+	// after a fill at 109.2 the first ask at 110 trips the breaker, a
+	// FOK order that needs the second one as well is killed untouched
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(109.2), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(110), NewDecimal(1))
+
+	fok = NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(110), NewDecimal(3))
+	fok.Owner = "Test_Other"
+	fok.TimeInForce = TIME_IN_FORCE_FOK
+
+	if err := exchange.Place(fok); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_EXPIRED || notice.Order.Amount != NewDecimal(3) {
+		t.Error("Expected the FOK order to expire unfilled at the circuit breaker")
+	}
+
+	if summary := exchange.Broadcast().Summaries[0]; summary.Halted || len(summary.Histories) != 4 {
+		t.Error("Expected no trade of the FOK order")
+	}
+
+	// an operator halt outlasting the circuit breaker keeps the stock
+	// halted, trading resumes only with the operator
+	exchange.Buy("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(110), NewDecimal(2))
+
+	expect := func(command string) {
+		select {
+		case event := <-exchange.Events():
+			if event.Command != command || event.Stock.Code != CODE {
+				t.Error("Expected a", command, "event, got", event.Command)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected a", command, "event")
+		}
+	}
+
+	expect(MESSAGE_COMMAND_HALT)
+
+	if err := exchange.Halt(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(MESSAGE_COMMAND_HALT)
+
+	select {
+	case event := <-exchange.Events():
+		t.Error("Expected no event while halted by the operator, got", event.Command)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err := exchange.Resume(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(MESSAGE_COMMAND_RESUME)
+}
+
+func TestExchangeHaltAndDelist(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(2))
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	waitDeals(exchange, 1)
+
+	if err := exchange.Halt(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err == nil {
+		t.Error("Expected an order to be rejected while halted")
+	}
+
+	if summary := exchange.Broadcast().Summaries[0]; !summary.Halted || summary.Depth[ORDER_TYPE_ASK].Best() == nil || summary.Depth[ORDER_TYPE_ASK].Best().Count != 1 {
+		t.Error("Expected a halted stock to keep its book")
+	}
+
+	if err := exchange.Resume(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a halt holds the orders of an auction at its end
+	if err := exchange.OpenAuction(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+
+	if err := exchange.Halt(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Uncross(CODE); err != nil {
+		t.Fatal(err)
+	}
+
+	if histories := exchange.Broadcast().Summaries[0].Histories; len(histories) != 1 {
+		t.Error("Expected no deal while halted")
+	}
+
+	if err := exchange.Resume(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeals(exchange, 2)
+
+	if histories := exchange.Broadcast().Summaries[0].Histories; len(histories) != 2 {
+		t.Error("Expected the queued orders to trade once resumed")
+	}
+
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(9), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(11), NewDecimal(1))
+
+	if err := exchange.Delist(CODE, "Test_Reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_CANCELLED {
+			t.Error("Expected the resting orders to be cancelled")
+		}
+	}
+
+	for _, asset := range []string{DEFAULT_MARKET, CODE} {
+		if balance, _ := exchange.Ledger().Balance("Test_Account", asset); balance.Held.IsPositive() {
+			t.Error("Expected the funds of the cancelled orders to be released")
+		}
+	}
+
+	if archive, err := exchange.Archive(CODE); err != nil || len(archive[DEFAULT_MARKET]) != 2 {
+		t.Error("Expected the deals of the stock to be archived")
+	}
+
+	if _, err := exchange.Phase(CODE); err == nil {
+		t.Error("Expected a delisted stock not to exist")
+	}
+
+	var actions []string
+
+	for _, entry := range exchange.Audit() {
+		actions = append(actions, entry.Action)
+	}
+
+	if strings.Join(actions, ",") != "HALT,RESUME,HALT,RESUME,DELIST" {
+		t.Error("Unexpected audit log", actions)
+	}
+
+	// the broker serves another stock
+	if err := issueTestStock(exchange, newTestStock("Test_Other_Code"), "Test_Account"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExchangeSupply(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+	)
+
+	// a spare broker so that only the code stops a second listing
+	exchange.Register(NewBroker())
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := exchange.Issue(stock, NewAllocation("Test_Holder", NewDecimalFromInt(1000))); err == nil {
+		t.Error("Expected allocations short of the circulating supply to be rejected")
+	}
+
+	if err := exchange.Issue(
+		stock,
+		NewAllocation("Test_Holder", NewDecimalFromInt(60000)),
+		NewAllocation("Test_Other", NewDecimalFromInt(30000)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Issue(stock, NewAllocation("Test_Other", NewDecimalFromInt(90000))); err == nil {
+		t.Error("Expected a stock code already listed to be rejected")
+	}
+
+	if balance, _ := exchange.Ledger().Balance("Test_Holder", CODE); balance.Available != NewDecimalFromInt(60000) {
+		t.Error("Expected the holder to be allocated 60000 shares, got", balance.Available)
+	}
+
+	if err := exchange.Ledger().Deposit("Test_Holder", CODE, NewDecimalFromInt(1000)); err == nil {
+		t.Error("Expected a deposit of listed shares to be rejected")
+	}
+
+	if err := exchange.Ledger().Withdraw("Test_Holder", CODE, NewDecimalFromInt(1000)); err == nil {
+		t.Error("Expected a withdrawal of listed shares to be rejected")
+	}
+
+	exchange.Ledger().Open("Test_Transferee")
+
+	if err := exchange.Ledger().Transfer("Test_Holder", "Test_Transferee", CODE, NewDecimalFromInt(70000)); err == nil {
+		t.Error("Expected a transfer beyond the holding to be rejected")
+	}
+
+	if err := exchange.Ledger().Transfer("Test_Holder", "Test_Transferee", CODE, NewDecimalFromInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if balance, _ := exchange.Ledger().Balance("Test_Transferee", CODE); balance.Available != NewDecimalFromInt(1000) {
+		t.Error("Expected the transferee to hold 1000 shares, got", balance.Available)
+	}
+
+	if err := exchange.Ledger().Transfer("Test_Transferee", "Test_Holder", CODE, NewDecimalFromInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Sell("Test_Holder", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimalFromInt(95000)); err == nil {
+		t.Error("Expected a sell beyond the circulating supply to be rejected")
+	}
+
+	if err := exchange.Offer(CODE, NewAllocation("Test_Other", NewDecimalFromInt(20000))); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Ledger().Open("Test_Issuer")
+	exchange.Ledger().Deposit("Test_Issuer", DEFAULT_MARKET, NewDecimalFromInt(20000))
+
+	if err := exchange.Buyback(CODE, DEFAULT_MARKET, "Test_Issuer", "Test_Holder", NewDecimal(2), NewDecimalFromInt(70000)); err == nil {
+		t.Error("Expected a buyback beyond the holding to be rejected")
+	}
+
+	if err := exchange.Buyback(CODE, DEFAULT_MARKET, "Test_Issuer", "Test_Holder", NewDecimal(3), NewDecimalFromInt(10000)); err == nil {
+		t.Error("Expected a buyback beyond the cash of the issuer to be rejected")
+	}
+
+	if err := exchange.Buyback(CODE, "BTC", "Test_Issuer", "Test_Holder", NewDecimal(2), NewDecimalFromInt(10000)); err == nil {
+		t.Error("Expected a buyback in a market the stock does not trade in to be rejected")
+	}
+
+	if err := exchange.Buyback(CODE, DEFAULT_MARKET, "Test_Issuer", "Test_Holder", NewDecimal(2), NewDecimalFromInt(10000)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id, asset string
+		available int64
+	}{
+		{"Test_Holder", CODE, 50000},
+		{"Test_Holder", DEFAULT_MARKET, 20000},
+		{"Test_Issuer", DEFAULT_MARKET, 0},
+	} {
+		if balance, _ := exchange.Ledger().Balance(c.id, c.asset); balance.Available != NewDecimalFromInt(c.available) {
+			t.Error("Expected", c.id, c.asset, c.available, "got", balance.Available)
+		}
+	}
+
+	events, err := exchange.Supply(CODE)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		kind               string
+		total, circulating int64
+	}{
+		{SUPPLY_ISSUE, 100000, 90000},
+		{SUPPLY_OFFERING, 120000, 110000},
+		{SUPPLY_BUYBACK, 120000, 100000},
+	} {
+		if i >= len(events) || events[i].Kind != c.kind || events[i].TotalSupply != NewDecimalFromInt(c.total) || events[i].CirculatingSupply != NewDecimalFromInt(c.circulating) {
+			t.Error("Unexpected supply event", i)
+		}
+	}
+}
+
+func TestExchangeCorporateActions(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+		record   = time.Now().Add(time.Hour)
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	stock.TickSize = NewDecimal(0.01)
+
+	if err := exchange.Issue(
+		stock,
+		NewAllocation("Test_Holder", NewDecimalFromInt(60000)),
+		NewAllocation("Test_Other", NewDecimalFromInt(30000)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Ledger().Deposit("Test_Other", DEFAULT_MARKET, NewDecimalFromInt(1000))
+	exchange.Ledger().Open("Test_Issuer")
+	exchange.Ledger().Deposit("Test_Issuer", DEFAULT_MARKET, NewDecimalFromInt(135000))
+
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(100))
+	ask.Owner = "Test_Holder"
+	bid := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(9), NewDecimal(100))
+	bid.Owner = "Test_Other"
+
+	for _, o := range []*Order{ask, bid} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a 3-for-1 split
+	if err := exchange.Split(CODE, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if level := depthAt(summary, ORDER_TYPE_ASK, NewDecimal(3.34)); level == nil || level.Amount != NewDecimal(300) {
+		t.Error("Expected the ask rescaled to 300 at 3.34")
+	}
+
+	if level := depthAt(summary, ORDER_TYPE_BID, NewDecimal(3)); level == nil || level.Amount != NewDecimal(300) {
+		t.Error("Expected the bid rescaled to 300 at 3")
+	}
+
+	if balance, _ := exchange.Ledger().Balance("Test_Holder", CODE); balance.Available != NewDecimalFromInt(179700) || balance.Held != NewDecimal(300) {
+		t.Error("Expected the position rescaled, got", balance.Available, balance.Held)
+	}
+
+	if err := exchange.Dividend(CODE, "Test_Issuer", DEFAULT_MARKET, NewDecimal(0.5), record); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Dividend(CODE, "Test_Issuer", "BTC", NewDecimal(0.5), record); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.StockDividend(CODE, NewDecimal(0.1), record); err != nil {
+		t.Fatal(err)
+	}
+
+	if cash, _ := exchange.Ledger().Balance("Test_Holder", DEFAULT_MARKET); cash.Available.IsPositive() {
+		t.Error("Expected no dividend before the record date")
+	}
+
+	exchange.SetClock(func() time.Time {
+		return record
+	})
+	exchange.Tick()
+
+	if cash, _ := exchange.Ledger().Balance("Test_Holder", DEFAULT_MARKET); cash.Available != NewDecimalFromInt(90000) {
+		t.Error("Expected a cash dividend of 90000, got", cash.Available)
+	}
+
+	if shares, _ := exchange.Ledger().Balance("Test_Other", CODE); shares.Total() != NewDecimalFromInt(99000) {
+		t.Error("Expected a stock dividend of 9000 shares, got", shares.Total())
+	}
+
+	events, _ := exchange.Supply(CODE)
+
+	if last := events[len(events)-1]; last.Kind != SUPPLY_DIVIDEND || last.TotalSupply != NewDecimalFromInt(327000) || last.CirculatingSupply != NewDecimalFromInt(297000) {
+		t.Error("Expected the supply to grow by the stock dividend")
+	}
+
+	if cash, _ := exchange.Ledger().Balance("Test_Issuer", DEFAULT_MARKET); !cash.Available.IsZero() {
+		t.Error("Expected the cash dividend paid by the issuer, left", cash.Available)
+	}
+
+	for _, action := range exchange.CorporateActions(CODE) {
+		if !action.Processed {
+			t.Error("Expected every corporate action to be processed")
+		}
+
+		// the issuer has nothing to pay the dividend in BTC with
+		if failed := action.Currency == "BTC"; failed != (action.Error != "") {
+			t.Error("Unexpected outcome of the corporate action", action.Kind, action.Currency, action.Error)
+		}
+	}
+
+	if cash, _ := exchange.Ledger().Balance("Test_Holder", "BTC"); !cash.Available.IsZero() {
+		t.Error("Expected no dividend the issuer cannot pay")
+	}
+
+	// a halt by the circuit breaker publishes the stock as it is now
+	exchange.SetBreaker(CODE, &CircuitBreaker{
+		Threshold: NewDecimal(0.01),
+		Period:    time.Hour,
+	})
+
+	exchange.Buy("Test_Other", CODE, DEFAULT_MARKET, NewDecimal(3.34), One)
+	exchange.Sell("Test_Holder", CODE, DEFAULT_MARKET, NewDecimal(3), One)
+
+	select {
+	case event := <-exchange.Events():
+		if event.Command != MESSAGE_COMMAND_HALT || event.Stock.CirculatingSupply != NewDecimalFromInt(297000) {
+			t.Error("Expected a halt of the stock with its current supply, got", event.Command, event.Stock.CirculatingSupply)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the circuit breaker to halt the stock")
+	}
+}
+
+func TestExchangeReverseSplit(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		stock    = newTestStock(CODE)
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	stock.TickSize = NewDecimal(0.01)
+	stock.LotSize = One
+	stock.MinAmount = NewDecimalFromInt(2)
+	stock.CirculatingSupply = NewDecimalFromInt(30000)
+
+	if err := exchange.Issue(
+		stock,
+		NewAllocation("Test_Holder", NewDecimalFromInt(20000)),
+		NewAllocation("Test_Other", NewDecimalFromInt(9999)),
+		NewAllocation("Test_Small", One),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange.Ledger().Deposit("Test_Other", DEFAULT_MARKET, NewDecimalFromInt(1000))
+
+	var (
+		ask   = NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimalFromInt(100))
+		bid   = NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(9.99), NewDecimalFromInt(10))
+		small = NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimalFromInt(2))
+	)
+
+	ask.Owner, bid.Owner, small.Owner = "Test_Holder", "Test_Other", "Test_Other"
+
+	for _, o := range []*Order{ask, bid, small} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a 1-for-3 reverse split
+	if err := exchange.Split(CODE, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_CANCELLED || notice.Order.OrderId != small.OrderId {
+		t.Error("Expected the ask left with no whole lot to be cancelled")
+	}
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	if best := summary.Depth[ORDER_TYPE_ASK].Best(); best == nil || best.Price != NewDecimalFromInt(30) || best.Amount != NewDecimalFromInt(33) || best.Count != 1 {
+		t.Error("Expected the ask rescaled to 33 at 30")
+	}
+
+	if best := summary.Depth[ORDER_TYPE_BID].Best(); best == nil || best.Price != NewDecimal(29.97) || best.Amount != NewDecimalFromInt(3) {
+		t.Error("Expected the bid rescaled to 3 at 29.97")
+	}
+
+	for _, c := range []struct {
+		id              string
+		available, held int64
+	}{
+		{"Test_Holder", 6633, 33},
+		{"Test_Other", 3333, 0},
+		{"Test_Small", 0, 0},
+	} {
+		if balance, _ := exchange.Ledger().Balance(c.id, CODE); balance.Available != NewDecimalFromInt(c.available) || balance.Held != NewDecimalFromInt(c.held) {
+			t.Error("Expected the position of", c.id, "rounded down to whole shares, got", balance.Available, balance.Held)
+		}
+	}
+
+	held := Zero
+
+	for _, shares := range exchange.Ledger().Holdings(CODE) {
+		held = held.Add(shares)
+	}
+
+	events, _ := exchange.Supply(CODE)
+
+	if last := events[len(events)-1]; last.TotalSupply != NewDecimalFromInt(33333) || last.CirculatingSupply != held || held != NewDecimalFromInt(9999) {
+		t.Error("Expected the circulating supply to match the positions, got", last.TotalSupply, last.CirculatingSupply, held)
+	}
+
+	if err := exchange.Sell("Test_Holder", CODE, DEFAULT_MARKET, NewDecimalFromInt(30), One); err != nil {
+		t.Error("Expected the minimum amount rescaled to a single share", err)
+	}
+}
+
+func TestExchangeSplitWhileTrading(t *testing.T) {
+	const (
+		CODE   = "Test_Code"
+		ORDERS = 200
+	)
+
+	var (
+		exchange = NewExchange()
+		wg       sync.WaitGroup
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < ORDERS; i++ {
+			exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+		}
+	}()
+
+	if err := exchange.Split(CODE, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	// a cancel is served after every order queued before it
+	exchange.Cancel(CODE, "Test_Unknown", "")
+
+	_, amount := resting(exchange.Broadcast().Summaries[0], ORDER_TYPE_ASK)
+
+	// every order admitted before the split is rescaled with its shares
+	if shares, _ := exchange.Ledger().Balance("Test_Account", CODE); shares.Held != amount {
+		t.Error("Expected the held shares to match the resting asks", shares.Held, amount)
+	}
+}
+
+func TestExchangeDepth(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.SetDepth(CODE, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	iceberg := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(5))
+	iceberg.Owner = "Test_Account"
+	iceberg.DisplayAmount = NewDecimal(2)
+
+	hidden := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimal(10), NewDecimal(4))
+	hidden.Owner = "Test_Account"
+	hidden.Hidden = true
+
+	for _, o := range []*Order{iceberg, hidden} {
+		if err := exchange.Place(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(11), NewDecimal(3))
+	exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(12), NewDecimal(1))
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(8), NewDecimal(1))
+	exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(9), NewDecimal(2))
+
+	summary := exchange.Broadcast().Summaries[0]
+
+	// the bids are queued last, once they rest every ask does too
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if bids, _ := resting(summary, ORDER_TYPE_BID); bids == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the orders to rest")
+		}
+		<-time.After(10 * time.Millisecond)
+		summary = exchange.Broadcast().Summaries[0]
+	}
+
+	asks := summary.Depth[ORDER_TYPE_ASK].Items
+
+	if len(asks) != 2 {
+		t.Fatal("Expected the asks limited to 2 levels, got", len(asks))
+	}
+
+	if asks[0].Price != NewDecimal(10) || asks[0].Amount != NewDecimal(3) || asks[0].Count != 2 || asks[0].Total != NewDecimal(30) {
+		t.Error("Expected 3 displayed in 2 orders at 10, got", asks[0].Amount, asks[0].Count)
+	}
+
+	if asks[1].Price != NewDecimal(11) || asks[1].Amount != NewDecimal(3) || asks[1].Count != 1 {
+		t.Error("Expected 3 in 1 order at 11")
+	}
+
+	if bid := summary.Depth[ORDER_TYPE_BID].Best(); bid == nil || bid.Price != NewDecimal(9) || bid.Amount != NewDecimal(2) {
+		t.Error("Expected the best bid of 2 at 9")
+	}
+
+	data, _ := json.Marshal(summary)
+
+	if strings.Contains(string(data), "order_id") || !strings.Contains(string(data), `"queues":{"ASK":{"items":[{"price":10,`) {
+		t.Error("Expected only the aggregated levels to be serialised, got", string(data))
+	}
+}
+
+func TestExchangeOutOfRange(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		price, amount Decimal
+	}{
+		{NewDecimalFromInt(1000000), NewDecimalFromInt(1000000)}, // value out of range
+		{NewDecimalFromInt(2000000000), One},                     // price out of range
+		{One, NewDecimalFromInt(2000000000)},                     // amount out of range
+	}
+
+	for _, c := range cases {
+		if err := exchange.Sell("Test_Account", CODE, DEFAULT_MARKET, c.price, c.amount); err == nil {
+			t.Error("Expected", c.price, c.amount, "to be rejected")
+		}
+	}
+
+	if err := exchange.BuyMarket("Test_Account", CODE, DEFAULT_MARKET, One, NewDecimalFromInt(2)); err == nil {
+		t.Error("Expected a slippage above 1 to be rejected")
+	}
+
+	ask := NewOrder(DEFAULT_MARKET, ORDER_TYPE_ASK, CODE, NewDecimalFromInt(100000000), One)
+	ask.Owner = "Test_Account"
+
+	if err := exchange.Place(ask); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Split(CODE, 100000000, 1); err == nil {
+		t.Error("Expected a split pushing a price out of range to be rejected")
+	}
+
+	if depthAt(exchange.Broadcast().Summaries[0], ORDER_TYPE_ASK, NewDecimalFromInt(100000000)) == nil {
+		t.Error("Expected the book to be left as it is")
+	}
+}
+
+func TestExchangeDayOrders(t *testing.T) {
+	const (
+		CODE = "Test_Code"
+	)
+
+	var (
+		exchange = NewExchange()
+		zone     = time.FixedZone("Test_Zone", 10*60*60)
+		// a Monday morning in the zone, still Sunday in UTC
+		now      = time.Date(2026, time.January, 5, 7, 0, 0, 0, zone)
+		schedule = NewSchedule(
+			Session{Phase: PHASE_CONTINUOUS, Start: 6 * time.Hour},
+			Session{Phase: PHASE_CLOSED, Start: 16 * time.Hour},
+		)
+	)
+
+	schedule.Location = zone
+
+	exchange.Register(NewBroker())
+	exchange.SetClock(func() time.Time {
+		return now
+	})
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.SetSchedule(CODE, schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	day := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	day.Owner = "Test_Account"
+	day.TimeInForce = TIME_IN_FORCE_DAY
+
+	if err := exchange.Place(day); err != nil {
+		t.Fatal(err)
+	}
+
+	if end := time.Date(2026, time.January, 5, 16, 0, 0, 0, zone); day.ExpireTs != end.Unix() {
+		t.Error("Expected a day order to expire at the close, got", time.Unix(day.ExpireTs, 0).In(zone))
+	}
+
+	// expiries follow the clock of the exchange rather than the wall clock
+	past := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	past.Owner = "Test_Account"
+	past.TimeInForce = TIME_IN_FORCE_GTD
+	past.ExpireTs = now.Add(-time.Second).Unix()
+
+	if err := exchange.Place(past); err == nil {
+		t.Error("Expected an expiry before the clock to be rejected")
+	}
+
+	gtd := NewOrder(DEFAULT_MARKET, ORDER_TYPE_BID, CODE, NewDecimal(10), NewDecimal(1))
+	gtd.Owner = "Test_Account"
+	gtd.TimeInForce = TIME_IN_FORCE_GTD
+	gtd.ExpireTs = now.Add(time.Second).Unix()
+
+	if err := exchange.Place(gtd); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := waitNotice(exchange); notice == nil || notice.Command != MESSAGE_COMMAND_EXPIRED || notice.Order.OrderId != gtd.OrderId {
+		t.Error("Expected the order to expire a second after the clock")
+	}
+}
+
+func TestExchangeDelistWhileTrading(t *testing.T) {
+	const (
+		CODE  = "Test_Code"
+		OTHER = "Test_Other"
+	)
+
+	var (
+		exchange = NewExchange()
+		wg       sync.WaitGroup
+	)
+
+	exchange.Register(NewBroker())
+
+	go exchange.Start()
+	defer exchange.Stop()
+
+	if err := issueTestStock(exchange, newTestStock(CODE), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exchange.Buy("Test_Account", CODE, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1))
+		}()
+	}
+
+	// only one of concurrent delists removes the stock
+	errs := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- exchange.Delist(CODE, "Test_Reason")
+		}()
+	}
+
+	if first, second := <-errs, <-errs; (first == nil) == (second == nil) {
+		t.Error("Expected exactly one delist to succeed", first, second)
+	}
+
+	wg.Wait()
+
+	// every order either was refused or has been cancelled
+	if cash, _ := exchange.Ledger().Balance("Test_Account", DEFAULT_MARKET); cash.Held.IsPositive() {
+		t.Error("Expected no cash held by orders of a delisted stock, got", cash.Held)
+	}
+
+	// the broker serves the next stock with a clean slate
+	if err := issueTestStock(exchange, newTestStock(OTHER), "Test_Account"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exchange.Buy("Test_Account", OTHER, DEFAULT_MARKET, NewDecimal(10), NewDecimal(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exchange.Cancel(OTHER, "Test_Missing"); err == nil {
+		t.Error("Expected an unknown order not to be cancelled")
+	}
+
+	if n, _ := resting(exchange.Broadcast().Summaries[0], ORDER_TYPE_BID); n != 1 {
+		t.Error("Expected only the order of the new stock in its book, got", n)
+	}
+}
@@ -11,17 +11,17 @@ func TestOrderList(t *testing.T) {
 		"Test_Stock_Name",
 		"Test_Code",
 		"Test_Description",
-		100000,
-		90000,
+		NewDecimalFromInt(100000),
+		NewDecimalFromInt(90000),
 		"/Test_Link",
 	)
 	r := rand.New(rand.NewSource(99))
 
-	book := NewBook()
+	book := NewBook(stock.Code)
 	ask := NewQueueAsk()
 	bid := NewQueueBid()
-	book.SetQueue("Ask", ask)
-	book.SetQueue("Bid", bid)
+	book.SetQueue(QueueKey("Test_Market", ORDER_TYPE_ASK), ask)
+	book.SetQueue(QueueKey("Test_Market", ORDER_TYPE_BID), bid)
 
 	for i := 0; i < 10; i++ {
 		ask.Add(
@@ -29,8 +29,8 @@ func TestOrderList(t *testing.T) {
 				"Test_Market",
 				ORDER_TYPE_ASK,
 				stock.Code,
-				r.Float64()*100,
-				r.Float64()*100,
+				NewDecimal(r.Float64()*100),
+				NewDecimal(r.Float64()*100),
 			),
 		)
 		bid.Add(
@@ -38,18 +38,18 @@ func TestOrderList(t *testing.T) {
 				"Test_Market",
 				ORDER_TYPE_BID,
 				stock.Code,
-				r.Float64()*100,
-				r.Float64()*100,
+				NewDecimal(r.Float64()*100),
+				NewDecimal(r.Float64()*100),
 			),
 		)
 	}
 
-	v1 := book.Sum().Queues["Ask"]
-	v2 := book.Sum().Queues["Bid"]
+	v1 := book.GetQueue(QueueKey("Test_Market", ORDER_TYPE_ASK))
+	v2 := book.GetQueue(QueueKey("Test_Market", ORDER_TYPE_BID))
 
-	var max float64 = -1.00
+	var max = NewDecimal(-1.00)
 	for next := v1.Next(); next != nil; next = v1.Next() {
-		if max > next.Price {
+		if max.GreaterThan(next.Price) {
 			t.Error(
 				"Queue not sorted",
 				"Expected",
@@ -61,9 +61,9 @@ func TestOrderList(t *testing.T) {
 		max = next.Price
 	}
 
-	var min float64 = 100.00
+	var min = NewDecimal(100.00)
 	for next := v2.Next(); next != nil; next = v2.Next() {
-		if min < next.Price {
+		if min.LessThan(next.Price) {
 			t.Error(
 				"Queue not sorted",
 				"Expected",
@@ -75,3 +75,115 @@ func TestOrderList(t *testing.T) {
 		min = next.Price
 	}
 }
+
+func TestOrderQueueTimePriority(t *testing.T) {
+	ask := NewQueueAsk()
+	bid := NewQueueBid()
+
+	var (
+		asks []*Order
+		bids []*Order
+	)
+
+	for i := 0; i < 5; i++ {
+		asks = append(asks, NewOrder("Test_Market", ORDER_TYPE_ASK, "Test_Code", NewDecimal(10), NewDecimal(float64(i+1))))
+		bids = append(bids, NewOrder("Test_Market", ORDER_TYPE_BID, "Test_Code", NewDecimal(10), NewDecimal(float64(i+1))))
+	}
+
+	// a better price always comes first regardless of arrival
+	better := NewOrder("Test_Market", ORDER_TYPE_ASK, "Test_Code", NewDecimal(9), NewDecimal(1))
+
+	// add out of sequence, time priority must still hold
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		ask.Add(asks[i])
+		bid.Add(bids[i])
+	}
+	ask.Add(better)
+
+	if next := ask.Next(); next != better {
+		t.Error("Expected best price first, got", next.Price)
+	}
+
+	for i := 0; i < 5; i++ {
+		if next := ask.Next(); next != asks[i] {
+			t.Error("Ask not in time priority at position", i)
+		}
+		if next := bid.Next(); next != bids[i] {
+			t.Error("Bid not in time priority at position", i)
+		}
+	}
+
+	if !ask.IsEmpty() || !bid.IsEmpty() {
+		t.Error("Expected empty queues")
+	}
+}
+
+func TestOrderQueuePeekAndRemove(t *testing.T) {
+	bid := NewQueueBid()
+
+	var orders []*Order
+
+	for _, price := range []float64{9, 11, 10, 11, 9, 10} {
+		o := NewOrder("Test_Market", ORDER_TYPE_BID, "Test_Code", NewDecimal(price), NewDecimal(1))
+		orders = append(orders, o)
+		bid.Add(o)
+	}
+
+	// a resting order leaves from the middle of its level and an
+	// emptied level leaves the queue
+	bid.Remove(orders[3].OrderId)
+	bid.Remove(orders[2].OrderId)
+	bid.Remove(orders[5].OrderId)
+
+	expected := []*Order{orders[1], orders[0], orders[4]}
+
+	for i, o := range expected {
+		if peeked := bid.Peek(i); peeked != o {
+			t.Error("Expected order", i, "in price-time priority, got", peeked.Price)
+		}
+	}
+
+	if bid.Peek(len(expected)) != nil || bid.Peek(-1) != nil {
+		t.Error("Expected nothing beyond the queue")
+	}
+
+	i := 0
+
+	bid.Range(func(o *Order) bool {
+		if o != expected[i] {
+			t.Error("Expected order", i, "in price-time priority, got", o.Price)
+		}
+		i++
+		return true
+	})
+
+	if i != len(expected) || bid.Len() != len(expected) {
+		t.Error("Expected", len(expected), "orders, got", i)
+	}
+
+	bid.Add(NewOrder("Test_Market", ORDER_TYPE_BID, "Test_Code", NewDecimal(10), NewDecimal(1)))
+
+	if bid.Peek(1).Price != NewDecimal(10) {
+		t.Error("Expected an emptied level to take new orders")
+	}
+}
+
+func TestAggregateOutOfRange(t *testing.T) {
+	ask := NewQueueAsk()
+
+	for i := 0; i < 2; i++ {
+		ask.Add(NewOrder("Test_Market", ORDER_TYPE_ASK, "Test_Code", NewDecimalFromInt(100000), NewDecimalFromInt(900000)))
+	}
+
+	ask.Add(NewOrder("Test_Market", ORDER_TYPE_ASK, "Test_Code", NewDecimalFromInt(100001), NewDecimalFromInt(1)))
+
+	depth := Aggregate(ask, 0)
+
+	if len(depth.Items) != 2 || depth.Items[0].Count != 2 || !depth.Items[0].Total.IsZero() {
+		t.Error("Expected the level out of range without a total")
+	}
+
+	if depth.Items[1].Total != NewDecimalFromInt(100001) {
+		t.Error("Expected the next level with its total, got", depth.Items[1].Total)
+	}
+}